@@ -0,0 +1,174 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+// Package admin is the embedded web server shared by all the listeners
+// running in one process, serving statistics, device sessions and commands.
+package admin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	dbh "lbsas/database"
+	"lbsas/utils"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// a device listener (tcp, tcp2, udp server) reporting its own statistics
+type Listener interface {
+	Name() string
+	Status() interface{}
+}
+
+var (
+	gRouter    = mux.NewRouter()
+	gListeners = make([]Listener, 0)
+	gLock      sync.RWMutex
+)
+
+// register a listener so that its statistics are served and reported
+func Register(l Listener) {
+	gLock.Lock()
+	defer gLock.Unlock()
+	gListeners = append(gListeners, l)
+	log.Debug("admin registered: ", l.Name())
+}
+
+// router of the embedded web server, for packages to add their own apis
+func Router() *mux.Router {
+	return gRouter
+}
+
+// start the embedded web server and the statistics reporter,
+// served over https if tlsConfig is not nil
+func Start(addr string, tlsConfig *tls.Config) {
+	reportor := log.New()
+	f, err := os.Create("report.log")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reportor.Out = f
+	reportor.Level = log.DebugLevel
+	go statusReport(reportor)
+
+	gRouter.HandleFunc("/api/sessions", sessionsHandler)
+	gRouter.HandleFunc("/api/sessions/{imei}", sessionHandler)
+	gRouter.HandleFunc("/api/identities", identitiesHandler)
+	gRouter.HandleFunc("/api/identities/{key}", identityHandler).Methods("DELETE")
+	gRouter.HandleFunc("/api/pending", pendingHandler).Methods("GET")
+	gRouter.HandleFunc("/api/pending/{imei}/approve", approveHandler).Methods("POST")
+	gRouter.HandleFunc("/api/pending/{imei}", discardHandler).Methods("DELETE")
+	gRouter.HandleFunc("/api/devices/{imei}/commands", createCmdHandler).Methods("POST")
+	gRouter.HandleFunc("/api/devices/{imei}/commands", listCmdsHandler).Methods("GET")
+	gRouter.HandleFunc("/api/commands/{id}", cancelCmdHandler).Methods("DELETE")
+	gRouter.HandleFunc("/api/{component}", apiHandler)
+	go func() {
+		var err error
+		if tlsConfig == nil {
+			err = http.ListenAndServe(addr, gRouter)
+		} else {
+			srv := &http.Server{Addr: addr, Handler: gRouter, TLSConfig: tlsConfig}
+			err = srv.ListenAndServeTLS("", "")
+		}
+		if err != nil {
+			log.Error("admin server: ", err)
+		}
+	}()
+}
+
+// write a json reply in the common {"success":..., "msg":...} style
+func Reply(w http.ResponseWriter, v interface{}) {
+	ret, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		ret = []byte("{\"success\":false, \"msg\":\"internal error\"}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// statistics of the listeners, all of them if name is empty
+func stats(name string) map[string]interface{} {
+	gLock.RLock()
+	defer gLock.RUnlock()
+	ret := make(map[string]interface{})
+	for _, v := range gListeners {
+		if name == "" || name == v.Name() {
+			ret[v.Name()] = v.Status()
+		}
+	}
+	return ret
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coapi := vars["component"]
+	switch coapi {
+	case "tcpstatus", "stats":
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		Reply(w, map[string]interface{}{
+			"success":    true,
+			"listeners":  stats(r.FormValue("listener")),
+			"database":   dbh.GetStat(),
+			"identities": dbh.GetIdentityStat(),
+			"goroutine":  runtime.NumGoroutine(),
+			"memalloc":   mem.Alloc,
+		})
+	case "listeners":
+		names := make([]string, 0)
+		for k := range stats("") {
+			names = append(names, k)
+		}
+		Reply(w, map[string]interface{}{"success": true, "listeners": names})
+	case "set":
+		lvl, err := utils.String2LogLevel(r.FormValue("loglevel"))
+		if err == nil {
+			log.SetLevel(lvl)
+		}
+		Reply(w, map[string]interface{}{"success": true, "msg": "loglevel set success"})
+	default:
+		Reply(w, map[string]interface{}{"success": false, "msg": "unknown api"})
+	}
+}
+
+// GET /api/identities: cache statistics
+// DELETE /api/identities: drop all the cached identities
+func identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "DELETE":
+		n := dbh.InvalidateIdentity("")
+		log.Info("identity cache invalidated, entries: ", n)
+		Reply(w, map[string]interface{}{"success": true, "invalidated": n})
+	default:
+		Reply(w, map[string]interface{}{"success": true, "identities": dbh.GetIdentityStat()})
+	}
+}
+
+// DELETE /api/identities/{key}: drop the cached identity of an imei or a
+// device id, e.g. after the device is re-assigned
+func identityHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	n := dbh.InvalidateIdentity(key)
+	log.Info("identity invalidated: ", key, ", entries: ", n)
+	Reply(w, map[string]interface{}{"success": true, "key": key, "invalidated": n})
+}
+
+// timer triggered every 120s to report statistics, one entry per listener
+func statusReport(reportor *log.Logger) {
+	reportor.Info("Report starting")
+	timeChan := time.NewTicker(time.Second * 120).C
+	for {
+		<-timeChan
+		for k, v := range stats("") {
+			reportor.WithField("listener", k).Info(v)
+		}
+		reportor.Info("database: ", dbh.GetStat())
+		reportor.Info("identities: ", dbh.GetIdentityStat())
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package admin
+
+import (
+	dbh "lbsas/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const DEFAULT_CMD_LIST_LIMIT = 50
+
+// json view of a command and its status history
+type cmdView struct {
+	Id               string          `json:"id"`
+	DeviceId         string          `json:"deviceId"`
+	Type             string          `json:"type"`
+	Params           string          `json:"params"`
+	Status           string          `json:"status"`
+	Priority         int             `json:"priority"`
+	CreateTime       int64           `json:"createTime"`
+	ExpireTime       int64           `json:"expireTime"`
+	LastSentTime     int64           `json:"lastSentTime"`
+	UpdateTime       int64           `json:"updateTime"`
+	MaxAttempts      int             `json:"maxAttempts"`
+	Attempts         int             `json:"attempts"`
+	RetryIntervalSec int             `json:"retryIntervalSec"`
+	History          []cmdStatusView `json:"history,omitempty"`
+}
+
+type cmdStatusView struct {
+	Status     string `json:"status"`
+	Attempts   int    `json:"attempts"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
+func newCmdView(c *dbh.TCMD) *cmdView {
+	return &cmdView{Id: c.Id, DeviceId: c.DeviceId, Type: c.Type, Params: c.Params, Status: c.Status,
+		Priority: c.Priority, CreateTime: c.CreateTime, ExpireTime: c.ExpireTime, LastSentTime: c.LastSentTime,
+		MaxAttempts: c.MaxAttempts, Attempts: c.Attempts, RetryIntervalSec: int(c.RetryInterval / time.Second)}
+}
+
+// optional int form value, def if missing
+func formInt(r *http.Request, key string, def int) (int, bool) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+// POST /api/devices/{imei}/commands: queue a command, form values:
+// type, params, priority, expire (seconds from now, 0 for never),
+// maxattempts, retry (seconds between the attempts). checked by the vendor
+// of the session, or the vendor the device last reported by if it's
+// offline. delivered right away if the device is connected
+func createCmdHandler(w http.ResponseWriter, r *http.Request) {
+	imei := mux.Vars(r)["imei"]
+	id, err := dbh.GetIdByImei(imei)
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": "unknown device: " + imei})
+		return
+	}
+
+	cmd := dbh.TCMD{DeviceId: id, Type: r.FormValue("type"), Params: r.FormValue("params")}
+	valid := cmd.Type != ""
+	num := func(key string) int {
+		n, ok := formInt(r, key, 0)
+		valid = valid && ok
+		return n
+	}
+	cmd.Priority = num("priority")
+	expire := num("expire")
+	cmd.MaxAttempts = num("maxattempts")
+	retry := num("retry")
+	if !valid {
+		Reply(w, map[string]interface{}{"success": false, "msg": "invalid command"})
+		return
+	}
+	if expire > 0 {
+		cmd.ExpireTime = time.Now().Add(time.Duration(expire)*time.Second).UnixNano() / 1000000
+	}
+	cmd.RetryInterval = time.Duration(retry) * time.Second
+
+	// the vendor of an offline device is the one it last reported by
+	vendor := ""
+	if sess := dbh.GetSession(imei); sess != nil {
+		vendor = sess.Vendor
+	} else if vendor, err = dbh.GetDeviceVendor(id); err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	if vendor == "" {
+		Reply(w, map[string]interface{}{"success": false, "msg": "unknown vendor of device: " + imei +
+			", it has never reported"})
+		return
+	}
+	cmd, sent, err := dbh.QueueCmd(vendor, cmd)
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "imei": imei, "command": newCmdView(&cmd), "sent": sent})
+}
+
+// GET /api/devices/{imei}/commands[?limit=n]: the latest commands of the
+// device, the newest first, with their status history
+func listCmdsHandler(w http.ResponseWriter, r *http.Request) {
+	imei := mux.Vars(r)["imei"]
+	id, err := dbh.GetIdByImei(imei)
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": "unknown device: " + imei})
+		return
+	}
+	limit, ok := formInt(r, "limit", DEFAULT_CMD_LIST_LIMIT)
+	if !ok || limit == 0 {
+		Reply(w, map[string]interface{}{"success": false, "msg": "invalid limit: " + r.FormValue("limit")})
+		return
+	}
+	cmds, err := dbh.GetCmdHistory(id, limit)
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	ret := make([]*cmdView, 0, len(cmds))
+	for _, c := range cmds {
+		v := newCmdView(&c.TCMD)
+		v.UpdateTime = c.UpdateTime
+		for _, s := range c.History {
+			v.History = append(v.History, cmdStatusView{s.Status, s.Attempts, s.UpdateTime})
+		}
+		ret = append(ret, v)
+	}
+	Reply(w, map[string]interface{}{"success": true, "imei": imei, "commands": ret})
+}
+
+// DELETE /api/commands/{id}: cancel a pending command
+func cancelCmdHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := dbh.CancelCmd(id); err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "id": id})
+}
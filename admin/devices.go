@@ -0,0 +1,53 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package admin
+
+import (
+	dbh "lbsas/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /api/pending: the unknown devices waiting for approval, their packets
+// are dropped, only counted
+func pendingHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := dbh.GetPendingDevices()
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "devices": devices})
+}
+
+// POST /api/pending/{imei}/approve[?owner=id]: provision the device, with
+// the default owner unless given
+func approveHandler(w http.ResponseWriter, r *http.Request) {
+	imei := mux.Vars(r)["imei"]
+	owner := 0
+	if v := r.FormValue("owner"); v != "" {
+		var err error
+		if owner, err = strconv.Atoi(v); err != nil {
+			Reply(w, map[string]interface{}{"success": false, "msg": "invalid owner: " + v})
+			return
+		}
+	}
+	id, err := dbh.ApproveDevice(imei, owner)
+	if err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "imei": imei, "deviceId": id})
+}
+
+// DELETE /api/pending/{imei}: forget the device, it's pending again if it
+// keeps reporting
+func discardHandler(w http.ResponseWriter, r *http.Request) {
+	imei := mux.Vars(r)["imei"]
+	if err := dbh.DiscardPendingDevice(imei); err != nil {
+		Reply(w, map[string]interface{}{"success": false, "msg": err.Error()})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "imei": imei})
+}
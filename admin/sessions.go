@@ -0,0 +1,47 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package admin
+
+import (
+	dbh "lbsas/database"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// json view of a live device session
+type sessionView struct {
+	Imei     string    `json:"imei"`
+	DeviceId string    `json:"deviceId"`
+	Vendor   string    `json:"vendor"`
+	Remote   string    `json:"remote"`
+	Local    string    `json:"local"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func newSessionView(s *dbh.Session) *sessionView {
+	return &sessionView{s.Imei, s.DeviceId, s.Vendor, s.RemoteAddr(), s.LocalAddr(), s.Since, s.LastSeen()}
+}
+
+// GET /api/sessions
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	ret := make([]*sessionView, 0)
+	for _, v := range dbh.GetSessions() {
+		ret = append(ret, newSessionView(v))
+	}
+	Reply(w, map[string]interface{}{"success": true, "sessions": ret})
+}
+
+// GET /api/sessions/{imei}
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	imei := mux.Vars(r)["imei"]
+	sess := dbh.GetSession(imei)
+	if sess == nil {
+		Reply(w, map[string]interface{}{"success": true, "imei": imei, "online": false})
+		return
+	}
+	Reply(w, map[string]interface{}{"success": true, "imei": imei, "online": true,
+		"session": newSessionView(sess)})
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DEFAULT_BATCH_SIZE     = 200
+	DEFAULT_BATCH_INTERVAL = 200 * time.Millisecond
+	// window of the throughput statistics
+	BATCH_RATE_WINDOW = 10 * time.Second
+)
+
+// batch writer statistics
+type BatchStat struct {
+	NumBatches, NumRows    uint64
+	AvgBatchSize           float64
+	AvgFlushMs, MaxFlushMs float64
+	RowsPerSec             float64
+}
+
+type batchStat struct {
+	lock                sync.Mutex
+	numBatches, numRows uint64
+	flushTime, maxFlush time.Duration
+	windowStart         time.Time
+	windowRows          uint64
+	rowsPerSec          float64
+}
+
+func (s *batchStat) add(rows int, d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.numBatches++
+	s.numRows += uint64(rows)
+	s.flushTime += d
+	if d > s.maxFlush {
+		s.maxFlush = d
+	}
+
+	now := time.Now()
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+	s.windowRows += uint64(rows)
+	if elapsed := now.Sub(s.windowStart); elapsed >= BATCH_RATE_WINDOW {
+		s.rowsPerSec = float64(s.windowRows) / elapsed.Seconds()
+		s.windowStart, s.windowRows = now, 0
+	}
+}
+
+func (s *batchStat) get() BatchStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := BatchStat{NumBatches: s.numBatches, NumRows: s.numRows, RowsPerSec: s.rowsPerSec,
+		MaxFlushMs: float64(s.maxFlush) / float64(time.Millisecond)}
+	if s.numBatches > 0 {
+		ret.AvgBatchSize = float64(s.numRows) / float64(s.numBatches)
+		ret.AvgFlushMs = float64(s.flushTime) / float64(time.Millisecond) / float64(s.numBatches)
+	}
+	return ret
+}
+
+// db writer: collects the positions of the messages on the pipe and stores
+// them by batches of size, or every interval. exits once the pipe is closed
+// and drained
+func (h *DbHelper) writer(size int, interval time.Duration) {
+	defer h.workers.Done()
+	batch := make([]*Position, 0, size)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item, ok := <-h.DBMsgChan:
+			if !ok {
+				h.flush(batch)
+				return
+			}
+			if item.Msg == nil {
+				continue
+			}
+			c := &DbHelper{capturing: true}
+			if err := item.Msg.SaveToDB(c); err != nil {
+				atomic.AddUint64(&h.Stat.NumDBMsgFailed, 1)
+				log.Error(err)
+				continue
+			}
+			batch = append(batch, c.captured...)
+			if len(batch) >= size {
+				h.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				h.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// store a batch at once, a sql storage does it with one multi-row insert of
+// the events and one update of the latest data per device
+func (h *DbHelper) flush(batch []*Position) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	// the positions buffered by the devices go into the history in order
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].Ts < batch[j].Ts })
+
+	ids := make([]string, 0, len(batch))
+	rows := make([]*Position, 0, len(batch))
+	for _, p := range batch {
+		id, err := LookupDevice(p.Imei, "", nil)
+		if err != nil {
+			h.failed(p, err)
+			continue
+		}
+		ids = append(ids, id)
+		rows = append(rows, p)
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	err := _Storage.SavePositions(ids, rows, false)
+	if err == nil {
+		atomic.AddUint64(&h.Stat.NumDBMsgStored, uint64(len(rows)))
+		h.batchStat.add(len(rows), time.Now().Sub(start))
+		raiseLowBatteries(ids, rows)
+		return
+	}
+	if Retryable(err) {
+		log.Error("batch of ", len(rows), " failed: ", err)
+		for _, p := range rows {
+			h.failed(p, err)
+		}
+		return
+	}
+
+	// a bad row fails the whole batch, store them one by one to skip it
+	log.Error("batch of ", len(rows), " failed, storing them one by one: ", err)
+	for _, p := range rows {
+		if err := savePosition(p, false); err != nil {
+			h.failed(p, err)
+		} else {
+			atomic.AddUint64(&h.Stat.NumDBMsgStored, 1)
+		}
+	}
+}
+
+// a position that can't be stored, spooled if the database is unreachable
+func (h *DbHelper) failed(p *Position, err error) {
+	if Retryable(err) && _Spool != nil && _Spool.Put(p) {
+		atomic.AddUint64(&h.Stat.NumDBMsgSpooled, 1)
+		return
+	}
+	atomic.AddUint64(&h.Stat.NumDBMsgFailed, 1)
+	log.Error(err, ", position: ", p)
+}
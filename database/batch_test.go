@@ -0,0 +1,59 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeExecer struct {
+	query string
+	args  []interface{}
+}
+
+func (f *fakeExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	f.query, f.args = query, args
+	return nil, nil
+}
+
+func TestInsertEvents(t *testing.T) {
+	ex := &fakeExecer{}
+	rows := []*Position{
+		{Imei: "1", Lat: "30.1", Lon: "120.1", Speed: "1", Heading: "90", Ts: 1},
+		{Imei: "2", Lat: "30.2", Lon: "120.2", Speed: "2", Heading: "180", Ts: 2, Battery: "85"},
+	}
+	insertEvents(ex, []string{"10", "20"}, rows)
+	if strings.Count(ex.query, "(?,?,?,?,?,?,?,?,?,?,?,?)") != 2 || len(ex.args) != 24 {
+		t.Fatal("unexpected insert:", ex.query, ex.args)
+	}
+	if ex.args[12] != "20" || ex.args[13] != int64(2) || ex.args[6] != nil || ex.args[8] != 0 ||
+		ex.args[10] != nil || ex.args[22] != "85" {
+		t.Fatal("unexpected args:", ex.args)
+	}
+
+	insertEvents(ex, []string{"10"}, []*Position{{Lat: "0", Lon: "0", Ts: 3, Event: "GTPNA", Data: "type=4", NoGPS: true}})
+	if ex.args[2] != nil || ex.args[6] != "GTPNA" || ex.args[7] != "type=4" {
+		t.Fatal("unexpected args:", ex.args)
+	}
+	updateLatest(ex, "10", &Position{Ts: 5, NoGPS: true, Voltage: "3.714"}, false)
+	if strings.Contains(ex.query, "gpsTimestamp") || len(ex.args) != 5 || ex.args[3] != "3.714" {
+		t.Fatal("unexpected update:", ex.query, ex.args)
+	}
+
+	updateLatest(ex, "10", &Position{Lat: "0", Lon: "0", Ts: 5}, true)
+	if strings.Contains(ex.query, "latitude") || !strings.Contains(ex.query, "gpsTimestamp<?") || len(ex.args) != 9 {
+		t.Fatal("unexpected update:", ex.query, ex.args)
+	}
+}
+
+func TestBatchStat(t *testing.T) {
+	s := &batchStat{}
+	s.add(100, 10*time.Millisecond)
+	s.add(50, 30*time.Millisecond)
+	stat := s.get()
+	if stat.NumBatches != 2 || stat.NumRows != 150 || stat.AvgBatchSize != 75 ||
+		stat.AvgFlushMs != 20 || stat.MaxFlushMs != 30 {
+		t.Fatal("unexpected stat:", stat)
+	}
+}
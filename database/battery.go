@@ -0,0 +1,136 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DEFAULT_LOW_BATTERY_PCT  = 20
+	DEFAULT_LOW_BATTERY_VOLT = 3.6
+	// the battery is low again only once it's been above the threshold by
+	// this much, so a level around the threshold raises one event
+	LOW_BATTERY_HYSTERESIS_PCT  = 5
+	LOW_BATTERY_HYSTERESIS_VOLT = 0.1
+	// raised once the battery of a device goes below the threshold
+	EVENT_LOW_BATTERY = "BATTERY_LOW"
+)
+
+// not positive to disable
+var _LowBatteryPct float64 = DEFAULT_LOW_BATTERY_PCT
+var _LowBatteryVolt float64 = DEFAULT_LOW_BATTERY_VOLT
+var _Batteries = &batteries{low: make(map[string]bool)}
+
+// the batteryLow flags of devicelatestdata, device id -> low, cached once
+// read or written
+type batteries struct {
+	lock sync.Mutex
+	low  map[string]bool
+}
+
+// the low battery event of a stored position, nil unless the battery of the
+// device has just gone below the threshold. the percentage is checked if
+// reported, the voltage otherwise. the backfilled positions are too old to
+// tell. the flag is persisted so the event is raised once whatever server
+// stores the position, and after a restart
+func (b *batteries) check(id string, p *Position) *Position {
+	if p.Backfill {
+		return nil
+	}
+	var low, high bool
+	data := ""
+	if v, err := strconv.ParseFloat(p.Battery, 64); err == nil && _LowBatteryPct > 0 {
+		low, high = v < _LowBatteryPct, v >= _LowBatteryPct+LOW_BATTERY_HYSTERESIS_PCT
+		data = "battery=" + p.Battery + ";threshold=" + strconv.FormatFloat(_LowBatteryPct, 'f', -1, 64)
+	} else if v, err := strconv.ParseFloat(p.Voltage, 64); err == nil && _LowBatteryVolt > 0 {
+		low, high = v < _LowBatteryVolt, v >= _LowBatteryVolt+LOW_BATTERY_HYSTERESIS_VOLT
+		data = "voltage=" + p.Voltage + ";threshold=" + strconv.FormatFloat(_LowBatteryVolt, 'f', -1, 64)
+	} else {
+		return nil
+	}
+
+	b.lock.Lock()
+	flagged, known := b.low[id]
+	b.lock.Unlock()
+	if high && (flagged || !known) {
+		if _, err := setBatteryLow(id, false); err != nil {
+			log.Error("can't clear the low battery of ", p.Imei, ": ", err)
+			return nil
+		}
+		b.cache(id, false)
+	}
+	if !low || flagged {
+		return nil
+	}
+	// raised before by another server, or before a restart, unless changed
+	changed, err := setBatteryLow(id, true)
+	if err != nil {
+		log.Error("can't flag the low battery of ", p.Imei, ": ", err)
+		return nil
+	}
+	b.cache(id, true)
+	if !changed {
+		return nil
+	}
+	log.Warn("low battery: ", p.Imei, ", ", data)
+	ev := *p
+	ev.Event, ev.Data = EVENT_LOW_BATTERY, data
+	return &ev
+}
+
+func (b *batteries) cache(id string, low bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.low[id] = low
+}
+
+// the event of the device couldn't be stored, it's raised again by the next
+// low position
+func (b *batteries) reset(id string) {
+	if _, err := setBatteryLow(id, false); err != nil {
+		log.Error("can't clear the low battery of device ", id, ": ", err)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.low, id)
+}
+
+// flag the battery of the device low or not, true if the flag has changed
+func setBatteryLow(id string, low bool) (bool, error) {
+	from, to := 1, 0
+	if low {
+		from, to = 0, 1
+	}
+	ret, err := _DB.Exec(rebind("UPDATE devicelatestdata SET batteryLow=? where deviceId=? and COALESCE(batteryLow, 0)=?"),
+		to, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := ret.RowsAffected()
+	return n > 0, err
+}
+
+// store the low battery events of the stored positions
+func raiseLowBatteries(ids []string, rows []*Position) {
+	evIds := make([]string, 0)
+	evs := make([]*Position, 0)
+	for i, p := range rows {
+		if ev := _Batteries.check(ids[i], p); ev != nil {
+			evIds = append(evIds, ids[i])
+			evs = append(evs, ev)
+		}
+	}
+	if len(evs) == 0 {
+		return
+	}
+	if err := _Storage.SavePositions(evIds, evs, false); err != nil {
+		log.Error("can't store the low battery events: ", err)
+		for _, id := range evIds {
+			_Batteries.reset(id)
+		}
+	}
+}
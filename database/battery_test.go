@@ -0,0 +1,53 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestLowBattery(t *testing.T) {
+	defer testDB(t)()
+	if _, err := _DB.Exec("insert into devicelatestdata(deviceId) values (1), (2)"); err != nil {
+		t.Fatal(err)
+	}
+	b := &batteries{low: make(map[string]bool)}
+	cases := []struct {
+		id  string
+		p   Position
+		low bool
+	}{
+		{"1", Position{Imei: "1", Battery: "50"}, false},
+		{"1", Position{Imei: "1", Battery: "19"}, true},
+		// once per crossing
+		{"1", Position{Imei: "1", Battery: "10"}, false},
+		// back above the threshold, but within the hysteresis
+		{"1", Position{Imei: "1", Battery: "22"}, false},
+		{"1", Position{Imei: "1", Battery: "18"}, false},
+		{"1", Position{Imei: "1", Battery: "30"}, false},
+		{"1", Position{Imei: "1", Battery: "18", Backfill: true}, false},
+		{"1", Position{Imei: "1", Battery: "18"}, true},
+		// the voltage of the devices without percentage
+		{"2", Position{Imei: "2", Voltage: "3.714"}, false},
+		{"2", Position{Imei: "2", Voltage: "3.5"}, true},
+		{"2", Position{Imei: "2"}, false},
+	}
+	for i, v := range cases {
+		ev := b.check(v.id, &v.p)
+		if (ev != nil) != v.low {
+			t.Fatal("unexpected event of case", i, ":", ev)
+		}
+		if ev != nil && (ev.Event != EVENT_LOW_BATTERY || ev.Imei != v.p.Imei) {
+			t.Fatal("unexpected event:", ev)
+		}
+	}
+
+	// raised once by the previous run, or another server
+	b = &batteries{low: make(map[string]bool)}
+	if ev := b.check("1", &Position{Imei: "1", Battery: "10"}); ev != nil {
+		t.Fatal("unexpected event:", ev)
+	}
+	// raised again if its event couldn't be stored
+	b.reset("2")
+	if ev := b.check("2", &Position{Imei: "2", Voltage: "3.5"}); ev == nil {
+		t.Fatal("expected the event raised again")
+	}
+}
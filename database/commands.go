@@ -0,0 +1,731 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	CMD_TYPE_REPINTV  = "REPINTV"
+	CMD_TYPE_SRVADDR  = "SRVADDR"
+	CMD_TYPE_WORKMODE = "WORKMODE"
+	// GL500 AT+GT commands, the params are the fields between the password
+	// and the serial number
+	CMD_TYPE_GTBSI = "GTBSI"
+	CMD_TYPE_GTSRI = "GTSRI"
+	CMD_TYPE_GTTMA = "GTTMA"
+	CMD_TYPE_GTGBC = "GTGBC"
+	CMD_TYPE_GTGEO = "GTGEO"
+	// the continuous and the fixed report, both set by the continuous
+	// report fields of GTGBC on GL500
+	CMD_TYPE_GTCTN = "GTCTN"
+	CMD_TYPE_GTFRI = "GTFRI"
+
+	// PENDING -> SENT, or FAILED once the attempts are used up,
+	// or EXPIRED if not sent in time. the commands of the devices with
+	// acks go on from SENT to ACKED, or UNCONFIRMED without ack in time.
+	// SRVADDR goes on from SENT to DONE once the device reconnected to the
+	// new address, or UNCONFIRMED
+	CMD_STATUS_PENDING     = "PENDING"
+	CMD_STATUS_SENT        = "SENT"
+	CMD_STATUS_ACKED       = "ACKED"
+	CMD_STATUS_DONE        = "DONE"
+	CMD_STATUS_UNCONFIRMED = "UNCONFIRMED"
+	CMD_STATUS_FAILED      = "FAILED"
+	CMD_STATUS_EXPIRED     = "EXPIRED"
+	// a pending command canceled by the api
+	CMD_STATUS_CANCELED = "CANCELED"
+
+	DEFAULT_CMD_MAX_ATTEMPTS   = 3
+	DEFAULT_CMD_RETRY_INTERVAL = time.Minute
+	DEFAULT_CMD_ACK_TIMEOUT    = 2 * time.Minute
+	// a device moved by SRVADDR reconnects in this duration
+	CMD_RECONNECT_TIMEOUT = 10 * time.Minute
+	// the queue is reloaded from the commands table every this interval
+	CMD_REFRESH_INTERVAL = 30 * time.Second
+)
+
+var (
+	// the command can't be sent as is, it fails without retries
+	ErrInvalidCmd = errors.New("invalid command")
+	// only the pending commands can be canceled
+	ErrCmdNotPending = errors.New("command not pending")
+)
+
+// a sent command is unconfirmed without ack in this duration
+var _CmdAckTimeout = DEFAULT_CMD_ACK_TIMEOUT
+
+// a command of the commands table
+type TCMD struct {
+	Id       string
+	DeviceId string
+	Type     string
+	Params   string
+	Status   string
+	// the higher first, then the older first
+	Priority int
+	// unix ms, ExpireTime 0 for never
+	CreateTime, ExpireTime, LastSentTime int64
+	MaxAttempts, Attempts                int
+	RetryInterval                        time.Duration
+
+	// not to be sent before
+	nextTry time.Time
+	// queued since
+	queued time.Time
+	// a sent command waits for its ack until
+	ackBy time.Time
+}
+
+// only the commands not sent yet expire
+func (c *TCMD) expired(now time.Time) bool {
+	return c.Status == CMD_STATUS_PENDING && c.ExpireTime > 0 && now.UnixNano()/1000000 >= c.ExpireTime
+}
+
+// the ack is not enough, the device is to reconnect to the new address
+func (c *TCMD) confirmedByReconnect() bool {
+	return c.Type == CMD_TYPE_SRVADDR
+}
+
+// vendor specific function writing a command onto the session,
+// ErrInvalidCmd if the command is not supported or its params are invalid
+type CmdWriter func(sess *Session, cmd TCMD) error
+
+// vendor specific check of a command before it's queued, ErrInvalidCmd if
+// the command is not supported or its params are invalid
+type CmdValidator func(cmd TCMD) error
+
+// vendor -> validator, registered by the vendors on init
+var _CmdValidators = make(map[string]CmdValidator)
+
+func RegisterCmdValidator(vendor string, v CmdValidator) {
+	_CmdValidators[vendor] = v
+}
+
+// a status change of a command
+type CmdStatus struct {
+	Status     string
+	Attempts   int
+	UpdateTime int64
+}
+
+// a command of the table with its status history, the oldest first
+type CmdRecord struct {
+	TCMD
+	UpdateTime int64
+	History    []CmdStatus
+}
+
+// pending commands of the devices in order, and the sent ones waiting for
+// their acks
+type cmdQueue struct {
+	lock     sync.Mutex
+	byDevice map[string][]*TCMD
+	byId     map[string]*TCMD
+}
+
+var _Cmds = newCmdQueue()
+
+func newCmdQueue() *cmdQueue {
+	return &cmdQueue{byDevice: make(map[string][]*TCMD), byId: make(map[string]*TCMD)}
+}
+
+// queue a command unless it's queued already, true if added
+func (q *cmdQueue) add(cmd *TCMD) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.byId[cmd.Id]; ok {
+		return false
+	}
+	if cmd.MaxAttempts <= 0 {
+		cmd.MaxAttempts = DEFAULT_CMD_MAX_ATTEMPTS
+	}
+	if cmd.RetryInterval <= 0 {
+		cmd.RetryInterval = DEFAULT_CMD_RETRY_INTERVAL
+	}
+	cmd.queued = time.Now()
+	q.byId[cmd.Id] = cmd
+	cmds := append(q.byDevice[cmd.DeviceId], cmd)
+	sort.SliceStable(cmds, func(i, j int) bool {
+		if cmds[i].Priority != cmds[j].Priority {
+			return cmds[i].Priority > cmds[j].Priority
+		}
+		return cmds[i].CreateTime < cmds[j].CreateTime
+	})
+	q.byDevice[cmd.DeviceId] = cmds
+	return true
+}
+
+// lock held
+func (q *cmdQueue) remove(cmd *TCMD) {
+	delete(q.byId, cmd.Id)
+	cmds := q.byDevice[cmd.DeviceId]
+	for i, v := range cmds {
+		if v == cmd {
+			cmds = append(cmds[:i], cmds[i+1:]...)
+			break
+		}
+	}
+	if len(cmds) == 0 {
+		delete(q.byDevice, cmd.DeviceId)
+	} else {
+		q.byDevice[cmd.DeviceId] = cmds
+	}
+}
+
+// the commands of the device to be sent now, in order. the expired ones are
+// dropped and returned as done
+func (q *cmdQueue) due(deviceId string, now time.Time) (due, done []TCMD) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, v := range append([]*TCMD(nil), q.byDevice[deviceId]...) {
+		if v.expired(now) {
+			v.Status = CMD_STATUS_EXPIRED
+			q.remove(v)
+			done = append(done, *v)
+		} else if v.Status == CMD_STATUS_PENDING && !now.Before(v.nextTry) {
+			due = append(due, *v)
+		}
+	}
+	return
+}
+
+// the result of writing a command, the command is returned with its new
+// state, false if it's not queued any more. a sent command is kept until
+// acked if awaitAck
+func (q *cmdQueue) sent(id string, err error, awaitAck bool, now time.Time) (TCMD, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	cmd, ok := q.byId[id]
+	if !ok {
+		return TCMD{}, false
+	}
+	cmd.Attempts++
+	switch {
+	case err == nil:
+		cmd.Status = CMD_STATUS_SENT
+		cmd.LastSentTime = now.UnixNano() / 1000000
+		if cmd.confirmedByReconnect() {
+			cmd.ackBy = now.Add(CMD_RECONNECT_TIMEOUT)
+		} else if awaitAck {
+			cmd.ackBy = now.Add(_CmdAckTimeout)
+		} else {
+			q.remove(cmd)
+		}
+	case err == ErrInvalidCmd || cmd.Attempts >= cmd.MaxAttempts:
+		cmd.Status = CMD_STATUS_FAILED
+		q.remove(cmd)
+	default:
+		cmd.nextTry = now.Add(cmd.RetryInterval)
+	}
+	return *cmd, true
+}
+
+// drop a pending command, false if it's not queued or sent already
+func (q *cmdQueue) cancel(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	cmd, ok := q.byId[id]
+	if !ok || cmd.Status != CMD_STATUS_PENDING {
+		return false
+	}
+	q.remove(cmd)
+	return true
+}
+
+// drop the expired commands of all devices
+func (q *cmdQueue) expire(now time.Time) []TCMD {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]TCMD, 0)
+	for _, v := range q.byId {
+		if v.expired(now) {
+			v.Status = CMD_STATUS_EXPIRED
+			q.remove(v)
+			ret = append(ret, *v)
+		}
+	}
+	return ret
+}
+
+// the oldest sent command of the device accepted by match is acked and
+// returned, false if none. the ones confirmed by reconnection are kept sent
+func (q *cmdQueue) ack(deviceId string, match func(cmd TCMD) bool) (TCMD, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var found *TCMD
+	for _, v := range q.byDevice[deviceId] {
+		if v.Status != CMD_STATUS_SENT || (found != nil && !sentBefore(v, found)) {
+			continue
+		}
+		if match(*v) {
+			found = v
+		}
+	}
+	if found == nil {
+		return TCMD{}, false
+	}
+	if found.confirmedByReconnect() {
+		return *found, true
+	}
+	found.Status = CMD_STATUS_ACKED
+	q.remove(found)
+	return *found, true
+}
+
+// the one sent first, the older command if sent at the same time
+func sentBefore(a, b *TCMD) bool {
+	if a.LastSentTime != b.LastSentTime {
+		return a.LastSentTime < b.LastSentTime
+	}
+	x, _ := strconv.ParseInt(a.Id, 10, 64)
+	y, _ := strconv.ParseInt(b.Id, 10, 64)
+	return x < y
+}
+
+// drop a command done by others, e.g. confirmed by another server
+func (q *cmdQueue) drop(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if cmd, ok := q.byId[id]; ok {
+		q.remove(cmd)
+	}
+}
+
+// drop the sent commands of all devices not acked in time
+func (q *cmdQueue) unconfirmed(now time.Time) []TCMD {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]TCMD, 0)
+	for _, v := range q.byId {
+		if v.Status == CMD_STATUS_SENT && !now.Before(v.ackBy) {
+			v.Status = CMD_STATUS_UNCONFIRMED
+			q.remove(v)
+			ret = append(ret, *v)
+		}
+	}
+	return ret
+}
+
+// merge the pending commands of the table, the queued ones missing from it
+// have been changed by others and are dropped unless queued after since.
+// the sent ones are kept for their acks
+func (q *cmdQueue) merge(cmds []*TCMD, since time.Time) {
+	ids := make(map[string]bool)
+	for _, v := range cmds {
+		ids[v.Id] = true
+		q.add(v)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for id, v := range q.byId {
+		if !ids[id] && v.Status == CMD_STATUS_PENDING && v.queued.Before(since) {
+			log.Debug("cmd changed by others, dropped: ", v.Id)
+			q.remove(v)
+		}
+	}
+}
+
+// the devices with commands to be sent now
+func (q *cmdQueue) dueDevices(now time.Time) []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]string, 0)
+	for deviceId, cmds := range q.byDevice {
+		for _, v := range cmds {
+			if v.Status == CMD_STATUS_PENDING && !now.Before(v.nextTry) {
+				ret = append(ret, deviceId)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// true if the command is queued, or sent by this server and not done
+func (q *cmdQueue) has(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, ok := q.byId[id]
+	return ok
+}
+
+func (q *cmdQueue) get(deviceId string) []TCMD {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]TCMD, 0)
+	for _, v := range q.byDevice[deviceId] {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+// write the due commands of the session's device in order, true if any has
+// been sent. every state change is committed to the commands table, the
+// sent commands wait for their acks if the session's device acks
+func SendCmds(sess *Session, write CmdWriter) bool {
+	now := time.Now()
+	due, done := _Cmds.due(sess.DeviceId, now)
+	for _, v := range done {
+		commitCmd(v)
+	}
+
+	_, acks := sess.cmdSender()
+	sent := false
+	for _, v := range due {
+		err := write(sess, v)
+		if err != nil {
+			log.Error("cmd not sent: ", v.Id, ", ", v.Type, ":", v.Params, ", to ", sess.Imei, ", ", err)
+		} else {
+			log.Info("cmd sent: ", v.Id, ", ", v.Type, ":", v.Params, ", to ", sess.Imei)
+			sent = true
+		}
+		if cmd, ok := _Cmds.sent(v.Id, err, acks, now); ok {
+			commitCmd(cmd)
+		}
+	}
+	return sent
+}
+
+// a command acked by the device, the oldest sent one that matches, so the
+// commands sharing a serial are acked in the order sent. the acked command
+// is committed and returned, false if none matches
+func AckCmd(deviceId string, match func(cmd TCMD) bool) (TCMD, bool) {
+	cmd, ok := _Cmds.ack(deviceId, match)
+	if !ok {
+		log.Warn("ack of no cmd sent to the device: ", deviceId)
+		return cmd, false
+	}
+	if cmd.Status == CMD_STATUS_SENT {
+		log.Info("cmd acked: ", cmd.Id, ", ", cmd.Type, ":", cmd.Params, ", by ", deviceId, ", waiting for the reconnection")
+		return cmd, true
+	}
+	log.Info("cmd acked: ", cmd.Id, ", ", cmd.Type, ":", cmd.Params, ", by ", deviceId)
+	commitCmd(cmd)
+	return cmd, true
+}
+
+// host:port of a SRVADDR command, the host an ipv4 address as the devices
+// take no names
+func ParseSrvAddr(params string) (net.IP, int, error) {
+	host, port, err := net.SplitHostPort(params)
+	if err != nil {
+		return nil, 0, ErrInvalidCmd
+	}
+	ip := net.ParseIP(host).To4()
+	n, err := strconv.Atoi(port)
+	if ip == nil || ip.IsUnspecified() || err != nil || n <= 0 || n > 65535 {
+		return nil, 0, ErrInvalidCmd
+	}
+	return ip, n, nil
+}
+
+// the addresses the devices reach this server by, ip:port. the local
+// addresses differ behind nat
+var _PublicAddrs = make(map[string]bool)
+
+// the public addresses of this server, invalid ones are skipped
+func setPublicAddrs(addrs []string) {
+	_PublicAddrs = make(map[string]bool)
+	for _, v := range addrs {
+		ip, port, err := ParseSrvAddr(strings.TrimSpace(v))
+		if err != nil {
+			log.Error("invalid public address: ", v)
+			continue
+		}
+		_PublicAddrs[net.JoinHostPort(ip.String(), strconv.Itoa(port))] = true
+	}
+}
+
+// a device moved by SRVADDR to one of the public addresses of this server
+// is connected on the port of it, the command is done. it's been sent by
+// another server sharing the database, the ones sent by this server are
+// left to time out as the device may have reconnected to it
+func confirmReconnect(sess *Session) {
+	if len(_PublicAddrs) == 0 {
+		return
+	}
+	_, port, err := net.SplitHostPort(sess.LocalAddr())
+	if err != nil {
+		return
+	}
+	rows, err := _DB.Query(rebind(`select a.id, a.params, a.attempts, a.lastSentTime from commands as a
+	join commandtypes as b on a.type=b.id where a.deviceId=? and b.type=? and a.status=?`),
+		sess.DeviceId, CMD_TYPE_SRVADDR, CMD_STATUS_SENT)
+	if err != nil {
+		log.Error("select from commands error: ", err)
+		return
+	}
+	done := make([]TCMD, 0)
+	for rows.Next() {
+		var params sql.NullString
+		var lastSent sql.NullInt64
+		cmd := TCMD{Status: CMD_STATUS_DONE}
+		if err := rows.Scan(&cmd.Id, &params, &cmd.Attempts, &lastSent); err != nil {
+			log.Error(err)
+			break
+		}
+		cmd.LastSentTime = lastSent.Int64
+		ip, n, err := ParseSrvAddr(params.String)
+		if err != nil || strconv.Itoa(n) != port || _Cmds.has(cmd.Id) {
+			continue
+		}
+		if _PublicAddrs[net.JoinHostPort(ip.String(), port)] {
+			done = append(done, cmd)
+		}
+	}
+	rows.Close()
+
+	for _, v := range done {
+		_Cmds.drop(v.Id)
+		log.Info("cmd done, device reconnected: ", v.Id, ", ", sess.Imei, " on ", sess.LocalAddr())
+		commitCmd(v)
+	}
+}
+
+// the queued commands of the device, in order
+func GetCmds(deviceId string) []TCMD {
+	return _Cmds.get(deviceId)
+}
+
+// persist the state of a command, with its history. the commands canceled
+// or done by others meanwhile are left as is
+func commitCmd(cmd TCMD) {
+	var lastSent interface{} = nil
+	if cmd.LastSentTime > 0 {
+		lastSent = cmd.LastSentTime
+	}
+	ret, err := _DB.Exec(rebind(`update commands set status=?, attempts=?, lastSentTime=?, updateTime=?
+	where id=? and status in (?,?)`), cmd.Status, cmd.Attempts, lastSent, time.Now().UnixNano()/1000000, cmd.Id,
+		CMD_STATUS_PENDING, CMD_STATUS_SENT)
+	if err == nil {
+		if n, e := ret.RowsAffected(); e == nil && n == 0 {
+			log.Debug("cmd changed by others, not committed: ", cmd.Id, ", status: ", cmd.Status)
+			return
+		}
+		err = addCmdHistory(rebinder{_DB, _Dialect}, cmd.Id)
+	}
+	log.Debug("committed cmd: ", cmd.Id, ", status: ", cmd.Status)
+	if err != nil {
+		log.Error("failed to commit cmd: ", cmd.Id, ", status: ", cmd.Status, ", error: ", err)
+	}
+}
+
+// the current status of a command into its history
+func addCmdHistory(ex execer, id interface{}) error {
+	_, err := ex.Exec(`INSERT INTO command_history(commandId, status, attempts, updateTime)
+	SELECT id, status, attempts, updateTime FROM commands WHERE id=?`, id)
+	return err
+}
+
+// queue a new command of the device, checked by the validator of the
+// vendor. the command is delivered right away if the device is connected,
+// true if it's been sent. returns the command with its id
+func QueueCmd(vendor string, cmd TCMD) (TCMD, bool, error) {
+	v, ok := _CmdValidators[vendor]
+	if !ok {
+		return cmd, false, ErrInvalidCmd
+	}
+	if err := v(cmd); err != nil {
+		return cmd, false, err
+	}
+	if cmd.MaxAttempts <= 0 {
+		cmd.MaxAttempts = DEFAULT_CMD_MAX_ATTEMPTS
+	}
+	if cmd.RetryInterval <= 0 {
+		cmd.RetryInterval = DEFAULT_CMD_RETRY_INTERVAL
+	}
+	cmd.Status, cmd.Attempts, cmd.LastSentTime = CMD_STATUS_PENDING, 0, 0
+	cmd.CreateTime = time.Now().UnixNano() / 1000000
+	var expireTime interface{} = nil
+	if cmd.ExpireTime > 0 {
+		expireTime = cmd.ExpireTime
+	}
+
+	tx, err := _DB.Begin()
+	if err != nil {
+		return cmd, false, err
+	}
+	var typeId int64
+	err = tx.QueryRow(rebind("select id from commandtypes where type=?"), cmd.Type).Scan(&typeId)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidCmd
+	}
+	var id int64
+	if err == nil {
+		id, err = _Dialect.insertId(tx, `insert into commands(deviceId, type, params, status, priority, createTime,
+		expireTime, maxAttempts, attempts, retryIntervalSec, updateTime) values (?,?,?,?,?,?,?,?,?,?,?)`,
+			cmd.DeviceId, typeId, cmd.Params, cmd.Status, cmd.Priority, cmd.CreateTime, expireTime,
+			cmd.MaxAttempts, 0, int(cmd.RetryInterval/time.Second), cmd.CreateTime)
+	}
+	if err == nil {
+		err = addCmdHistory(rebinder{tx, _Dialect}, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return cmd, false, err
+	}
+
+	cmd.Id = strconv.FormatInt(id, 10)
+	queued := cmd
+	_Cmds.add(&queued)
+	log.Info("cmd queued: ", cmd.Id, ", ", cmd.Type, ":", cmd.Params, ", to ", cmd.DeviceId)
+	return cmd, DeliverCmds(cmd.DeviceId), nil
+}
+
+// cancel a pending command, ErrCmdNotPending if it's been sent or done. a
+// command being written meanwhile may still reach the device
+func CancelCmd(id string) error {
+	_Cmds.cancel(id)
+	ret, err := _DB.Exec(rebind("update commands set status=?, updateTime=? where id=? and status=?"),
+		CMD_STATUS_CANCELED, time.Now().UnixNano()/1000000, id, CMD_STATUS_PENDING)
+	if err != nil {
+		return err
+	}
+	if n, err := ret.RowsAffected(); err == nil && n == 0 {
+		return ErrCmdNotPending
+	}
+	log.Info("cmd canceled: ", id)
+	return addCmdHistory(rebinder{_DB, _Dialect}, id)
+}
+
+// the latest commands of the device, the newest first, with their history
+func GetCmdHistory(deviceId string, limit int) ([]*CmdRecord, error) {
+	rows, err := _DB.Query(rebind(`select a.id, a.deviceId, b.type, a.params, a.status, a.priority,
+	a.createTime, a.expireTime, a.lastSentTime, a.maxAttempts, a.attempts, a.retryIntervalSec, a.updateTime
+	from commands as a left outer join commandtypes as b on a.type=b.id where a.deviceId=?
+	order by a.id desc limit ?`), deviceId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*CmdRecord, 0)
+	byId := make(map[string]*CmdRecord)
+	for rows.Next() {
+		var (
+			cmdType, params                              sql.NullString
+			createTime, expireTime, lastSent, updateTime sql.NullInt64
+			retryInterval                                int
+		)
+		c := &CmdRecord{}
+		err := rows.Scan(&c.Id, &c.DeviceId, &cmdType, &params, &c.Status, &c.Priority, &createTime,
+			&expireTime, &lastSent, &c.MaxAttempts, &c.Attempts, &retryInterval, &updateTime)
+		if err != nil {
+			return nil, err
+		}
+		c.Type, c.Params = cmdType.String, params.String
+		c.CreateTime, c.ExpireTime, c.LastSentTime = createTime.Int64, expireTime.Int64, lastSent.Int64
+		c.RetryInterval = time.Duration(retryInterval) * time.Second
+		c.UpdateTime = updateTime.Int64
+		c.History = make([]CmdStatus, 0)
+		ret = append(ret, c)
+		byId[c.Id] = c
+	}
+	if err := rows.Err(); err != nil || len(ret) == 0 {
+		return ret, err
+	}
+
+	ids := make([]string, 0, len(ret))
+	args := make([]interface{}, 0, len(ret))
+	for _, v := range ret {
+		ids = append(ids, "?")
+		args = append(args, v.Id)
+	}
+	hist, err := _DB.Query(rebind(`select commandId, status, attempts, updateTime from command_history
+	where commandId in (`+strings.Join(ids, ",")+`) order by id`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer hist.Close()
+	for hist.Next() {
+		var (
+			id         string
+			s          CmdStatus
+			updateTime sql.NullInt64
+		)
+		if err := hist.Scan(&id, &s.Status, &s.Attempts, &updateTime); err != nil {
+			return nil, err
+		}
+		s.UpdateTime = updateTime.Int64
+		if c, ok := byId[id]; ok {
+			c.History = append(c.History, s)
+		}
+	}
+	return ret, hist.Err()
+}
+
+// the pending commands of the table
+func loadCmds() ([]*TCMD, error) {
+	rows, err := _DB.Query(rebind(`select a.id, a.deviceId, b.type, a.params, a.priority, a.createTime,
+	a.expireTime, a.maxAttempts, a.attempts, a.retryIntervalSec from commands as a
+	left outer join commandtypes as b on a.type=b.id where a.status=? order by a.id`), CMD_STATUS_PENDING)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*TCMD, 0)
+	for rows.Next() {
+		var (
+			cmdType, params        sql.NullString
+			createTime, expireTime sql.NullInt64
+			retryInterval          int
+		)
+		cmd := &TCMD{Status: CMD_STATUS_PENDING}
+		err := rows.Scan(&cmd.Id, &cmd.DeviceId, &cmdType, &params, &cmd.Priority, &createTime,
+			&expireTime, &cmd.MaxAttempts, &cmd.Attempts, &retryInterval)
+		if err != nil {
+			return nil, err
+		}
+		if !cmdType.Valid {
+			log.Error("cmd of unknown type: ", cmd.Id)
+			continue
+		}
+		cmd.Type, cmd.Params = cmdType.String, params.String
+		cmd.CreateTime, cmd.ExpireTime = createTime.Int64, expireTime.Int64
+		cmd.RetryInterval = time.Duration(retryInterval) * time.Second
+		ret = append(ret, cmd)
+	}
+	return ret, rows.Err()
+}
+
+// reload the queue from the commands table, expire the commands, give up
+// the acks not received in time and deliver
+// the due ones, new or to be retried, to the connected devices
+func refreshCmds() {
+	since := time.Now()
+	cmds, err := loadCmds()
+	if err != nil {
+		log.Error("select from commands error: ", err)
+		return
+	}
+	_Cmds.merge(cmds, since)
+	for _, v := range _Cmds.expire(time.Now()) {
+		commitCmd(v)
+	}
+	for _, v := range _Cmds.unconfirmed(time.Now()) {
+		log.Warn("cmd not acked in time: ", v.Id, ", ", v.Type, ":", v.Params, ", to ", v.DeviceId)
+		commitCmd(v)
+	}
+
+	// no need to wait for the next uplink of the connected devices
+	for _, deviceId := range _Cmds.dueDevices(time.Now()) {
+		go DeliverCmds(deviceId)
+	}
+}
@@ -0,0 +1,334 @@
+package database
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdQueue(t *testing.T) {
+	defer testDB(t)()
+	defer func(q *cmdQueue) { _Cmds = q }(_Cmds)
+	_Cmds = newCmdQueue()
+
+	for _, q := range []string{
+		`insert into commands(id, deviceId, type, params, priority, createTime, expireTime, maxAttempts)
+		values (1, 9, 1, 'a', 0, 1, null, 3), (2, 9, 1, 'b', 5, 2, null, 3), (3, 9, 1, 'c', 0, 0, null, 2),
+		(4, 9, 1, 'd', 0, 4, 1, 3), (5, 9, 99, 'e', 0, 5, null, 3), (6, 8, 1, 'f', 0, 6, null, 3)`,
+	} {
+		if _, err := _DB.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmds, err := loadCmds()
+	if err != nil || len(cmds) != 5 {
+		t.Fatal("unexpected cmds:", len(cmds), err)
+	}
+	_Cmds.merge(cmds, time.Now())
+
+	// by priority then age, the expired one dropped, the one of unknown type skipped
+	order := ""
+	errWrite := errors.New("broken pipe")
+	sess := &Session{DeviceId: "9"}
+	sent := SendCmds(sess, func(sess *Session, cmd TCMD) error {
+		order += cmd.Params
+		switch cmd.Params {
+		case "a":
+			return ErrInvalidCmd
+		case "c":
+			return errWrite
+		}
+		return nil
+	})
+	if !sent || order != "bca" {
+		t.Fatal("unexpected order:", order)
+	}
+
+	status := func(id string) (s string, attempts int) {
+		if err := _DB.QueryRow("select status, attempts from commands where id=?", id).Scan(&s, &attempts); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	for id, want := range map[string]string{"1": CMD_STATUS_FAILED, "2": CMD_STATUS_SENT,
+		"3": CMD_STATUS_PENDING, "4": CMD_STATUS_EXPIRED} {
+		if s, _ := status(id); s != want {
+			t.Fatal("unexpected status of", id, ":", s, "expected", want)
+		}
+	}
+
+	// retried after the interval, failed once the attempts are used up
+	if due, _ := _Cmds.due("9", time.Now()); len(due) != 0 {
+		t.Fatal("expected no retry yet:", due)
+	}
+	later := time.Now().Add(DEFAULT_CMD_RETRY_INTERVAL)
+	if due, _ := _Cmds.due("9", later); len(due) != 1 || due[0].Params != "c" {
+		t.Fatal("expected a retry:", due)
+	}
+	cmd, _ := _Cmds.sent("3", errWrite, false, later)
+	commitCmd(cmd)
+	if s, n := status("3"); s != CMD_STATUS_FAILED || n != 2 {
+		t.Fatal("expected failed:", s, n)
+	}
+	if len(GetCmds("9")) != 0 || len(GetCmds("8")) != 1 {
+		t.Fatal("unexpected queue:", GetCmds("9"), GetCmds("8"))
+	}
+
+	// changed by others
+	if _, err := _DB.Exec("update commands set status='CANCELED' where id=6"); err != nil {
+		t.Fatal(err)
+	}
+	cmds, _ = loadCmds()
+	_Cmds.merge(cmds, time.Now())
+	if len(GetCmds("8")) != 0 {
+		t.Fatal("expected the canceled cmd dropped")
+	}
+}
+
+func TestCmdAck(t *testing.T) {
+	defer testDB(t)()
+	defer func(q *cmdQueue) { _Cmds = q }(_Cmds)
+	_Cmds = newCmdQueue()
+
+	if _, err := _DB.Exec(`insert into commands(id, deviceId, type, params, createTime)
+	values (1, 9, 1, 'a', 1), (2, 9, 1, 'b', 2), (3, 9, 1, 'c', 3)`); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := loadCmds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_Cmds.merge(cmds, time.Now())
+
+	now := time.Now()
+	for i, id := range []string{"1", "2", "3"} {
+		if cmd, ok := _Cmds.sent(id, nil, true, now.Add(time.Duration(i)*time.Second)); ok {
+			commitCmd(cmd)
+		}
+	}
+	// kept while waiting for the acks, not sent again
+	if len(GetCmds("9")) != 3 {
+		t.Fatal("expected the sent cmds queued:", GetCmds("9"))
+	}
+	if due, _ := _Cmds.due("9", now.Add(time.Hour)); len(due) != 0 {
+		t.Fatal("unexpected due:", due)
+	}
+	// still queued after a reload
+	cmds, _ = loadCmds()
+	_Cmds.merge(cmds, time.Now())
+	if len(GetCmds("9")) != 3 {
+		t.Fatal("expected the sent cmds kept:", GetCmds("9"))
+	}
+
+	// the oldest matching one
+	if cmd, ok := AckCmd("9", func(cmd TCMD) bool { return cmd.Params != "a" }); !ok || cmd.Params != "b" {
+		t.Fatal("unexpected ack:", cmd, ok)
+	}
+	if _, ok := AckCmd("9", func(cmd TCMD) bool { return cmd.Params == "b" }); ok {
+		t.Fatal("expected no cmd acked twice")
+	}
+	if _, ok := AckCmd("8", func(cmd TCMD) bool { return true }); ok {
+		t.Fatal("expected no cmd of another device")
+	}
+
+	if ret := _Cmds.unconfirmed(now.Add(_CmdAckTimeout - time.Second)); len(ret) != 0 {
+		t.Fatal("unexpected unconfirmed:", ret)
+	}
+	for _, v := range _Cmds.unconfirmed(now.Add(_CmdAckTimeout + time.Second)) {
+		commitCmd(v)
+	}
+
+	var s string
+	for id, want := range map[string]string{"1": CMD_STATUS_UNCONFIRMED, "2": CMD_STATUS_ACKED,
+		"3": CMD_STATUS_SENT} {
+		if err := _DB.QueryRow("select status from commands where id=?", id).Scan(&s); err != nil || s != want {
+			t.Fatal("unexpected status of", id, ":", s, err, "expected", want)
+		}
+	}
+}
+
+func TestCmdAckOldest(t *testing.T) {
+	defer testDB(t)()
+	defer func(q *cmdQueue) { _Cmds = q }(_Cmds)
+	_Cmds = newCmdQueue()
+	// the same serial on the devices, e.g. id&0xFFFF
+	if _, err := _DB.Exec(`insert into commands(id, deviceId, type, params, createTime)
+	values (65537, 9, 1, 'a', 1), (1, 9, 1, 'b', 2), (131073, 9, 1, 'c', 3)`); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := loadCmds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_Cmds.merge(cmds, time.Now())
+
+	now := time.Now()
+	for id, at := range map[string]time.Time{"65537": now, "1": now, "131073": now.Add(-time.Second)} {
+		if cmd, ok := _Cmds.sent(id, nil, true, at); ok {
+			commitCmd(cmd)
+		}
+	}
+	same := func(cmd TCMD) bool { return cmd.Params != "" }
+	for _, want := range []string{"c", "b", "a"} {
+		if cmd, ok := AckCmd("9", same); !ok || cmd.Params != want {
+			t.Fatal("unexpected ack:", cmd, ok, "expected", want)
+		}
+	}
+}
+
+func TestQueueCmd(t *testing.T) {
+	defer testDB(t)()
+	defer func(q *cmdQueue) { _Cmds = q }(_Cmds)
+	_Cmds = newCmdQueue()
+	RegisterCmdValidator("test", func(cmd TCMD) error {
+		if cmd.Params == "" {
+			return ErrInvalidCmd
+		}
+		return nil
+	})
+	defer delete(_CmdValidators, "test")
+
+	for _, v := range []struct {
+		vendor string
+		cmd    TCMD
+	}{
+		{"test", TCMD{DeviceId: "9", Type: CMD_TYPE_REPINTV}},
+		{"none", TCMD{DeviceId: "9", Type: CMD_TYPE_REPINTV, Params: "a"}},
+		{"test", TCMD{DeviceId: "9", Type: "UNKNOWN", Params: "a"}},
+	} {
+		if _, _, err := QueueCmd(v.vendor, v.cmd); err != ErrInvalidCmd {
+			t.Fatal("expected invalid:", v, err)
+		}
+	}
+
+	a, sent, err := QueueCmd("test", TCMD{DeviceId: "9", Type: CMD_TYPE_REPINTV, Params: "a", Priority: 1})
+	if err != nil || sent || a.Id == "" || a.Status != CMD_STATUS_PENDING {
+		t.Fatal("unexpected cmd:", a, sent, err)
+	}
+	b, _, err := QueueCmd("test", TCMD{DeviceId: "9", Type: CMD_TYPE_REPINTV, Params: "b"})
+	if err != nil || b.Id == a.Id {
+		t.Fatal("unexpected cmd:", b, err)
+	}
+	if cmds := GetCmds("9"); len(cmds) != 2 || cmds[0].Id != a.Id {
+		t.Fatal("unexpected queue:", cmds)
+	}
+
+	SendCmds(&Session{DeviceId: "9"}, func(sess *Session, cmd TCMD) error {
+		return nil
+	})
+	if err := CancelCmd(a.Id); err != ErrCmdNotPending {
+		t.Fatal("expected a sent cmd not canceled:", err)
+	}
+
+	c, _, _ := QueueCmd("test", TCMD{DeviceId: "9", Type: CMD_TYPE_REPINTV, Params: "c"})
+	if err := CancelCmd(c.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(GetCmds("9")) != 0 {
+		t.Fatal("expected the canceled cmd dropped:", GetCmds("9"))
+	}
+
+	cmds, err := GetCmdHistory("9", 10)
+	if err != nil || len(cmds) != 3 {
+		t.Fatal("unexpected history:", cmds, err)
+	}
+	want := map[string][]string{
+		a.Id: {CMD_STATUS_PENDING, CMD_STATUS_SENT},
+		b.Id: {CMD_STATUS_PENDING, CMD_STATUS_SENT},
+		c.Id: {CMD_STATUS_PENDING, CMD_STATUS_CANCELED},
+	}
+	for i, v := range cmds {
+		if i == 0 && v.Id != c.Id {
+			t.Fatal("expected the newest first:", v.Id)
+		}
+		s := make([]string, 0)
+		for _, h := range v.History {
+			s = append(s, h.Status)
+		}
+		if strings.Join(s, ",") != strings.Join(want[v.Id], ",") || v.Status != s[len(s)-1] {
+			t.Fatal("unexpected history of", v.Id, ":", v.Status, s)
+		}
+	}
+	if cmds, _ := GetCmdHistory("9", 1); len(cmds) != 1 {
+		t.Fatal("expected the limit:", cmds)
+	}
+}
+
+func TestSrvAddr(t *testing.T) {
+	for _, v := range []string{"", "1.2.3.4", "1.2.3.4:0", "1.2.3.4:65536", "host:9020", "0.0.0.0:9020", "[::1]:9020"} {
+		if _, _, err := ParseSrvAddr(v); err != ErrInvalidCmd {
+			t.Error("expected invalid:", v)
+		}
+	}
+	if ip, port, err := ParseSrvAddr("10.0.0.1:9020"); err != nil || ip.String() != "10.0.0.1" || port != 9020 {
+		t.Error("unexpected addr:", ip, port, err)
+	}
+
+	defer testDB(t)()
+	defer func(q *cmdQueue) { _Cmds = q }(_Cmds)
+	_Cmds = newCmdQueue()
+	RegisterCmdValidator("test", func(cmd TCMD) error { return nil })
+	defer delete(_CmdValidators, "test")
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	other, _, _ := QueueCmd("test", TCMD{DeviceId: "9", Type: CMD_TYPE_SRVADDR, Params: "10.0.0.1:1"})
+	cmd, _, _ := QueueCmd("test", TCMD{DeviceId: "9", Type: CMD_TYPE_SRVADDR, Params: "10.0.0.1:" + strconv.Itoa(port)})
+	SendCmds(&Session{DeviceId: "9", Acks: true}, func(sess *Session, cmd TCMD) error {
+		return nil
+	})
+	// acked but still waiting for the reconnection
+	if _, ok := AckCmd("9", func(TCMD) bool { return true }); !ok || len(GetCmds("9")) != 2 {
+		t.Fatal("expected the cmds kept:", GetCmds("9"))
+	}
+
+	var s string
+	status := func(id string) string {
+		if err := _DB.QueryRow("select status from commands where id=?", id).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	defer setPublicAddrs(nil)
+	sess := &Session{Imei: "x", DeviceId: "9", UdpConn: conn}
+	// not a public address of this server
+	confirmReconnect(sess)
+	setPublicAddrs([]string{"10.0.0.2:" + strconv.Itoa(port)})
+	confirmReconnect(sess)
+	// sent by this server
+	setPublicAddrs([]string{"10.0.0.1:" + strconv.Itoa(port)})
+	confirmReconnect(sess)
+	if status(cmd.Id) != CMD_STATUS_SENT {
+		t.Fatal("unexpected status:", s)
+	}
+
+	// the new server
+	sending := _Cmds
+	_Cmds = newCmdQueue()
+	confirmReconnect(sess)
+	// the sending server drops it once timed out
+	_Cmds = sending
+	_Cmds.drop(cmd.Id)
+	for id, want := range map[string]string{cmd.Id: CMD_STATUS_DONE, other.Id: CMD_STATUS_SENT} {
+		if err := _DB.QueryRow("select status from commands where id=?", id).Scan(&s); err != nil || s != want {
+			t.Fatal("unexpected status of", id, ":", s, err, "expected", want)
+		}
+	}
+	if cmds := GetCmds("9"); len(cmds) != 1 || cmds[0].Id != other.Id {
+		t.Fatal("unexpected queue:", cmds)
+	}
+
+	// the timeout of the other server doesn't overwrite it
+	commitCmd(TCMD{Id: cmd.Id, Status: CMD_STATUS_UNCONFIRMED})
+	if _DB.QueryRow("select status from commands where id=?", cmd.Id).Scan(&s); s != CMD_STATUS_DONE {
+		t.Fatal("unexpected status:", s)
+	}
+}
@@ -12,15 +12,16 @@ import (
 	"io/ioutil"
 	. "lbsas/datatypes"
 	"lbsas/gcj02"
+	"lbsas/pool"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
 type IDBMessage interface {
@@ -31,36 +32,52 @@ type IGPSProto interface {
 	New(args ...interface{}) IGPSProto
 	IsValid() bool
 	IsWhole() int
+	// device identity of a whole packet, the packets of one device are
+	// handled in order by the same worker
+	DeviceKey() string
 	HandleMsg() bool
 	SaveToDB(*DbHelper) error
 }
 
-type TCMD struct {
-	Id     string
-	Type   string
-	Params string
-	Status string
-}
-
-const (
-	CMD_TYPE_REPINTV   = "REPINTV"
-	CMD_TYPE_SRVADDR   = "SRVADDR"
-	CMD_STATUS_APPLIED = "APPLIED"
-	CMD_STATUS_PENDING = "PENDING"
-)
-
 var _DB *sql.DB = nil
-var _ImeiToId map[string]string = nil
-var _IdToImei map[string]string = nil
-var _CmdsList map[string]*TCMD = nil
-var _DBMsgChan chan IDBMessage = nil
+var _Identities = newIdentityCache(DEFAULT_IDENTITY_TTL, DEFAULT_IDENTITY_NEG_TTL)
+var _DBMsgChan chan DBItem = nil
+var _Helper *DbHelper = nil
+var _Spool *Spool = nil
 
 var DB *sql.DB = _DB
-var DBMsgChan chan IDBMessage = _DBMsgChan
+var DBMsgChan chan DBItem = _DBMsgChan
+
+// a message on the database pipe and the device it belongs to
+type DBItem struct {
+	Key string
+	Msg IDBMessage
+}
 
 type DbHelper struct {
 	*sql.DB
-	DBMsgChan chan IDBMessage
+	DBMsgChan chan DBItem
+	Stat      DBStat
+
+	// overflow handling of DBMsgChan, spill goes to the spool
+	Opts  pool.Options
+	Drops pool.Drops
+
+	// a capturing helper collects the positions instead of storing them
+	capturing bool
+	captured  []*Position
+
+	batchStat batchStat
+
+	// guards DBMsgChan against being closed while a message is put
+	closeLock sync.RWMutex
+	closed    bool
+	workers   sync.WaitGroup
+}
+
+// database writer statistics, updated atomically
+type DBStat struct {
+	NumDBMsgStored, NumDBMsgFailed, NumDBMsgDropped, NumDBMsgSpooled uint64
 }
 
 // initialized in New()
@@ -114,30 +131,6 @@ func GetCellLocationBD(args ...string) (lat, lon string) {
 	return
 }
 
-func SetCmd(deviceId, cmdType string, cmd *TCMD) {
-	_CmdsList[deviceId+":"+cmdType] = cmd
-}
-
-func DeleteCmd(deviceId, cmdType string) {
-	delete(_CmdsList, deviceId+":"+cmdType)
-	log.Debug("deleted cmdfrom ram, deviceId=", deviceId, ", cmdType=", cmdType)
-}
-
-func DeleteCmdFromDb(cmd *TCMD) {
-	CommitCmdToDb(cmd, "DELETED")
-}
-
-func GetCmd(deviceId, cmdType string) *TCMD {
-	ret, ok := _CmdsList[deviceId+":"+cmdType]
-	if ok {
-		//
-	} else {
-		ret = nil
-	}
-	log.Debug("got cmd from RAM: ", ret)
-	return ret
-}
-
 func GetCmdTypes() []string {
 	var ret []string = make([]string, 0)
 	rows, err := _DB.Query(`select type from commandtypes`)
@@ -161,262 +154,489 @@ func GetCmdTypes() []string {
 	return ret
 }
 
-func GetCmds(deviceId string) []*TCMD {
-	cmdTypes := GetCmdTypes()
-	ret := make([]*TCMD, 0)
-	for _, v := range cmdTypes {
-		if cmd, ok := _CmdsList[deviceId+":"+v]; ok {
-			ret = append(ret, cmd)
+func GetImeiById(id string) (string, error) {
+	if imei, ok := _Identities.getImei(id); ok {
+		if imei == "" {
+			return "no such device", sql.ErrNoRows
 		}
-		log.Debug("got cmds from RAM: ", ret)
+		return imei, nil
 	}
-	return ret
+
+	var deviceImei string
+	err := _DB.QueryRow(rebind("select deviceImei from device where id=?"), id).Scan(&deviceImei)
+	if err == sql.ErrNoRows {
+		_Identities.putMissingId(id)
+		return "no such device", sql.ErrNoRows
+	}
+	if err != nil {
+		log.Error(err, id)
+		return "", err
+	}
+	_Identities.put(id, deviceImei)
+	return deviceImei, nil
 }
 
-func GetCmdFromDb(deviceId, cmdType string) *TCMD {
-	var (
-		id_, deviceId_, cmdType_, params_ string
-	)
-	status_ := "PENDING"
-	//select a.id, b.type, a.params, a.status from commands as a left outer join commandtypes as b on  a.type=b.id
-	err := _DB.QueryRow(`select a.id,a.deviceId,b.type,a.params from commands 
-	as a left outer join commandtypes as b on a.type=b.id where a.status='PENDING' and a.deviceId=? and b.type=?`, deviceId, cmdType).Scan(&id_, &deviceId_, &cmdType_, &params_)
+func GetIdByImei(imei string) (string, error) {
+	if id, ok := _Identities.getId(imei); ok {
+		if id == "" {
+			return "no such device", sql.ErrNoRows
+		}
+		return id, nil
+	}
 
+	qStr := rebind("select id from device where deviceImei=?")
+	var id string
+	err := _DB.QueryRow(qStr, imei).Scan(&id)
+	if err == sql.ErrNoRows {
+		log.Error(sql.ErrNoRows, qStr, imei)
+		_Identities.putMissingImei(imei)
+		return "no such device", sql.ErrNoRows
+	}
 	if err != nil {
-		log.Error("failed query cmd for device: ", deviceId, ", type: ", cmdType, " error:", err)
-		return nil
+		log.Error(err, ", Query:", qStr, imei)
+		return "", err
 	}
-	cmd := &TCMD{id_, cmdType_, params_, status_}
-	log.Debug("Got cmd from db: ", cmd)
+	_Identities.put(id, imei)
+	return id, nil
+}
 
-	return cmd
+// the protocol password of a device, empty if it's never been set
+func GetDevicePassword(deviceId string) (string, error) {
+	var pwd sql.NullString
+	err := _DB.QueryRow(rebind("select password from device where id=?"), deviceId).Scan(&pwd)
+	return pwd.String, err
 }
 
-func CommitCmdToDb(cmd *TCMD, status string) {
-	_, err := _DB.Query("update commands set status=? where id=?", status, cmd.Id)
-	log.Debug("committed cmd to: ", cmd, "; status: ", status)
-	if err != nil {
-		log.Error("failed to commit cmd:", cmd, "error: ", err)
-	}
+// record the password the device has accepted
+func SetDevicePassword(deviceId, password string) error {
+	_, err := _DB.Exec(rebind("UPDATE device SET password=? where id=?"), password, deviceId)
+	return err
 }
 
-func GetImeiById(id string) (string, error) {
-	if imei, ok := _IdToImei[id]; ok {
-		return imei, nil
-	} else {
-		rows, err := _DB.Query("select id, deviceImei from device where id=?", id)
-		if err != nil {
-			log.Error(err, id)
-			return "", err
-		}
+// the vendors recorded on the devices, so the device rows are updated once
+// per process
+type deviceVendors struct {
+	lock sync.Mutex
+	m    map[string]string
+}
 
-		defer rows.Close()
-		var (
-			id         string
-			deviceImei string
-		)
-		if rows.Next() {
-			err := rows.Scan(&id, &deviceImei)
-			if err != nil {
-				log.Error(err)
-			}
-			_IdToImei[id] = deviceImei
-			_ImeiToId[deviceImei] = id
-		} else {
-			return "no such device", sql.ErrNoRows
-		}
-		err = rows.Err()
-		if err != nil {
-			log.Error(err)
-		}
-		return deviceImei, nil
+var _Vendors = &deviceVendors{m: make(map[string]string)}
+
+// record the vendor the device has reported by, empty for unknown
+func (v *deviceVendors) record(deviceId, vendor string) {
+	if vendor == "" {
+		return
 	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.m[deviceId] == vendor {
+		return
+	}
+	if _, err := _DB.Exec(rebind("UPDATE device SET vendor=? where id=?"), vendor, deviceId); err != nil {
+		log.Error("can't record the vendor of ", deviceId, ": ", err)
+		return
+	}
+	v.m[deviceId] = vendor
 }
 
-func GetIdByImei(imei string) (string, error) {
-	if id, ok := _ImeiToId[imei]; ok {
-		return id, nil
-	} else {
-		qStr := "select id, deviceImei from device where deviceImei=?"
-		rows, err := _DB.Query(qStr, imei)
-		if err != nil {
-			log.Error(err, imei)
-			return "", err
-		}
-
-		defer rows.Close()
-		var (
-			id         string
-			deviceImei string
-		)
-		if rows.Next() {
-			err := rows.Scan(&id, &deviceImei)
-			if err != nil {
-				log.Error(err, ", Query:", qStr, imei)
-			}
-			_IdToImei[id] = deviceImei
-			_ImeiToId[deviceImei] = id
-		} else {
-			log.Error(sql.ErrNoRows, qStr, imei)
-			return "no such device", sql.ErrNoRows
-		}
+// the vendor of a device, empty if it's never reported
+func GetDeviceVendor(deviceId string) (string, error) {
+	var vendor sql.NullString
+	err := _DB.QueryRow(rebind("select vendor from device where id=?"), deviceId).Scan(&vendor)
+	return vendor.String, err
+}
 
-		return id, rows.Err()
+// drop the cached identity of an imei or a device id, all of them if key
+// is empty. returns the num of entries dropped
+func InvalidateIdentity(key string) int {
+	if key == "" {
+		return _Identities.invalidateAll()
+	}
+	if _Identities.invalidate(key) {
+		return 1
 	}
+	return 0
 }
 
-//user:password@tcp(127.0.0.1:3306)/hello
+func GetIdentityStat() IdentityStat {
+	return _Identities.stat()
+}
+
+// env.DBAddr is the dsn of env.DBDriver, see the dialects.
+// the helper, its command cache and db workers are shared by all the
+// listeners in the process, later calls return the same instance
 func New(env EnviromentCfg) *DbHelper {
+	if _Helper != nil {
+		return _Helper
+	}
+
 	log.SetLevel(env.LogLevel)
 	log.SetFormatter(&log.TextFormatter{})
 	LbsUrl = env.LbsUrl
 	var err error = nil
 
-	if _DB == nil {
-		_DB, err = sql.Open("mysql", env.DBAddr)
+	_Dialect, err = getDialect(env.DBDriver)
+	if err != nil {
+		log.Panic(err)
+		return nil
+	}
+	_DB, err = sql.Open(_Dialect.name, env.DBAddr)
+	if err != nil {
+		log.Panic(err)
+		return nil
+	}
+	switch env.Storage {
+	case "", STORAGE_SQL:
+		_Storage = newSQLStorage(_DB, _Dialect)
+	case STORAGE_MONGO:
+		_Storage, err = newMongoStorage(env.MongoAddr)
 		if err != nil {
-			log.Panic(err)
+			log.Panic("mongo storage: ", err)
 			return nil
 		}
+	default:
+		log.Panic("unsupported storage: ", env.Storage)
+		return nil
+	}
+	log.Info("storage: ", _Storage.Name())
 
-		_IdToImei = make(map[string]string)
-		_ImeiToId = make(map[string]string)
-		_CmdsList = make(map[string]*TCMD)
-		_DBMsgChan = make(chan IDBMessage, env.DBCacheSize)
+	if env.UnknownPolicy != "" {
+		if !ValidUnknownPolicy(env.UnknownPolicy) {
+			log.Panic("unsupported unknown device policy: ", env.UnknownPolicy)
+			return nil
+		}
+		_UnknownPolicy = env.UnknownPolicy
+	}
+	_DefaultOwner = env.DefaultOwner
+	if env.CmdAckTimeoutSec > 0 {
+		_CmdAckTimeout = time.Duration(env.CmdAckTimeoutSec) * time.Second
+	}
+	setPublicAddrs(env.PublicAddrs)
+	if env.LowBatteryPct != 0 {
+		_LowBatteryPct = env.LowBatteryPct
+	}
+	if env.LowBatteryVolt != 0 {
+		_LowBatteryVolt = env.LowBatteryVolt
+	}
+	_Identities = newIdentityCache(time.Duration(env.IdentityTTLSec)*time.Second,
+		time.Duration(env.IdentityNegTTLSec)*time.Second)
+	_DBMsgChan = make(chan DBItem, env.DBCacheSize)
+
+	helper := &DbHelper{DB: _DB, DBMsgChan: _DBMsgChan}
+	_Helper = helper
+	if env.SpoolDir != "" {
+		_Spool, err = NewSpool(env.SpoolDir, env.SpoolMaxMB<<20)
+		if err != nil {
+			log.Error("spool disabled: ", err)
+		} else {
+			go _Spool.Replay(replayPosition, Retryable)
+		}
+	}
+	if env.DBQueuePolicy != "" {
+		opts, err := pool.ParsePolicy(env.DBQueuePolicy)
+		if err != nil || (opts.Policy == pool.Spill && _Spool == nil) {
+			log.Error("unsupported database queue policy: ", env.DBQueuePolicy, ", using ", helper.Opts)
+		} else {
+			helper.Opts = opts
+		}
 	}
 
-	helper := &DbHelper{_DB, _DBMsgChan}
+	if env.TCPTimeOutSec > 0 {
+		_SessionTimeout = time.Duration(env.TCPTimeOutSec) * time.Second
+	}
 
 	_DB.SetMaxIdleConns(env.DBMaxIdleConns)
 	_DB.SetMaxOpenConns(env.DBMaxOpenConns)
 
-	var refreshCmdsList = func() {
-		errSqlStr := "select from commands error:"
-		rows, err := _DB.Query(`select a.id,a.deviceId,b.type,a.params from commands as a  
-		left outer join commandtypes as b on a.type=b.id where status='PENDING'`)
-		if err != nil {
-			log.Error(errSqlStr, err)
-			return
+	// periodically reload the commands, right away for the ones left by
+	// the previous run
+	go func() {
+		refreshCmds()
+		timeChan := time.NewTicker(CMD_REFRESH_INTERVAL).C
+		for {
+			<-timeChan
+			refreshCmds()
 		}
+	}()
 
-		defer rows.Close()
-		var (
-			id, deviceId, cmdType, params, status string
-		)
-
-		status = "PENDING"
-		for rows.Next() {
-			err := rows.Scan(&id, &deviceId, &cmdType, &params)
-			if err != nil {
-				log.Error(err)
-				break
-			}
+	// periodically drop the expired udp sessions
+	go func() {
+		timeChan := time.NewTicker(_SessionTimeout).C
+		for {
+			<-timeChan
+			expireSessions()
+		}
+	}()
 
-			_cmd, ok := _CmdsList[deviceId+":"+cmdType]
-			if ok {
-				// modify the status of the old record in DB
-				if _cmd.Status != status && _cmd.Id == id {
-					//helper.CommitCmdToDb(_cmd, "APPLIED")
-				} else if _cmd.Id != id {
-					CommitCmdToDb(_cmd, "OVERWRITE")
-				}
+	// setup db writers, they exit once the chan is closed and drained
+	writers, size, interval := env.DBWriters, env.DBBatchSize, time.Duration(env.DBBatchIntervalMs)*time.Millisecond
+	if writers < 1 {
+		writers = 1
+	}
+	if size < 1 {
+		size = DEFAULT_BATCH_SIZE
+	}
+	if interval <= 0 {
+		interval = DEFAULT_BATCH_INTERVAL
+	}
+	for i := 0; i < writers; i++ {
+		helper.workers.Add(1)
+		go helper.writer(size, interval)
+	}
+	log.Info("db writers: ", writers, ", batch size: ", size, ", interval: ", interval)
 
-				// update RAM
-				_cmd.Id = id
-				_cmd.Params = params
-				_cmd.Status = status
-				log.Debug("RAM cmd: ", _cmd)
+	//
+	return helper
+}
 
-			} else {
-				cmd := &TCMD{id, cmdType, params, status}
-				log.Debug("RAM cmd: ", cmd)
-				_CmdsList[deviceId+":"+cmdType] = cmd
-			}
+func (h *DbHelper) drop(key string) {
+	atomic.AddUint64(&h.Stat.NumDBMsgDropped, 1)
+	h.Drops.Add(key)
+}
+
+// put a message of the device key onto the database pipe, assured!!
+// on overflow the policy of the helper applies, false is returned if any
+// message has been dropped, including the new one after Shutdown()
+func (h *DbHelper) Put(key string, msg IDBMessage) bool {
+	h.closeLock.RLock()
+	defer h.closeLock.RUnlock()
+	if h.closed {
+		h.drop(key)
+		return false
+	}
+
+	item := DBItem{key, msg}
+	switch h.Opts.Policy {
+	case pool.DropNewest:
+		select {
+		case h.DBMsgChan <- item:
+			return true
+		default:
+			h.drop(key)
+			return false
 		}
-		err = rows.Err()
-		if err != nil {
-			log.Error(errSqlStr, err)
+	case pool.Block:
+		select {
+		case h.DBMsgChan <- item:
+			return true
+		default:
+		}
+		timer := time.NewTimer(h.Opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case h.DBMsgChan <- item:
+			return true
+		case <-timer.C:
+			h.drop(key)
+			return false
 		}
+	case pool.Spill:
+		select {
+		case h.DBMsgChan <- item:
+			return true
+		default:
+		}
+		if spoolMessage(msg) {
+			atomic.AddUint64(&h.Stat.NumDBMsgSpooled, 1)
+			return true
+		}
+		h.drop(key)
+		return false
 	}
 
-	// periodically update commands list
-	go func() {
-		timeChan := time.NewTicker(time.Second * 60 / 2).C
-		for {
-			<-timeChan
-			//
-			refreshCmdsList()
+	ret := true
+	for {
+		select {
+		case h.DBMsgChan <- item:
+			return ret
+		default:
+			// database pipe overflow, pop the oldest one and insert the new one
+			select {
+			case old := <-h.DBMsgChan:
+				h.drop(old.Key)
+				ret = false
+			default:
+			}
 		}
+	}
+}
+
+// store the positions of a message onto the spool, false if any of them
+// can't be spooled
+func spoolMessage(msg IDBMessage) bool {
+	if _Spool == nil {
+		return false
+	}
+	c := &DbHelper{capturing: true}
+	if err := msg.SaveToDB(c); err != nil {
+		log.Error("can't spool message: ", err)
+		return false
+	}
+	ret := true
+	for _, p := range c.captured {
+		ret = _Spool.Put(p) && ret
+	}
+	return ret
+}
+
+// database pipe statistics
+type DBQueueStat struct {
+	DBStat
+	Policy              string
+	Pending             int
+	NumDroppedByDevices map[string]uint64
+	Spool               *SpoolStat
+	Batch               BatchStat
+}
+
+func GetStat() *DBQueueStat {
+	h := _Helper
+	if h == nil {
+		return nil
+	}
+	return &DBQueueStat{
+		DBStat: DBStat{
+			NumDBMsgStored:  atomic.LoadUint64(&h.Stat.NumDBMsgStored),
+			NumDBMsgFailed:  atomic.LoadUint64(&h.Stat.NumDBMsgFailed),
+			NumDBMsgDropped: atomic.LoadUint64(&h.Stat.NumDBMsgDropped),
+			NumDBMsgSpooled: atomic.LoadUint64(&h.Stat.NumDBMsgSpooled),
+		},
+		Policy:              h.Opts.String(),
+		Pending:             len(h.DBMsgChan),
+		NumDroppedByDevices: h.Drops.Top(pool.TOP_DROPS),
+		Spool:               spoolStat(),
+		Batch:               h.batchStat.get(),
+	}
+}
+
+func spoolStat() *SpoolStat {
+	if _Spool == nil {
+		return nil
+	}
+	stat := _Spool.Stat()
+	return &stat
+}
+
+// stop accepting messages and wait until the db workers have saved every
+// queued message or the deadline is reached.
+// returns the num of messages flushed and dropped during the shutdown
+func Shutdown(deadline time.Time) (flushed, dropped uint64) {
+	h := _Helper
+	if h == nil {
+		return 0, 0
+	}
+
+	stored := atomic.LoadUint64(&h.Stat.NumDBMsgStored)
+	failed := atomic.LoadUint64(&h.Stat.NumDBMsgFailed)
+	dropped0 := atomic.LoadUint64(&h.Stat.NumDBMsgDropped)
+	log.Info("flushing ", len(h.DBMsgChan), " queued database messages")
+
+	h.closeLock.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.DBMsgChan)
+	}
+	h.closeLock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		h.workers.Wait()
+		close(done)
 	}()
 
-	// setup dbworker pool
-	for i := 0; i < env.DBMaxOpenConns; i++ {
-		go func() {
-			for {
-				msg := <-_DBMsgChan
-				if msg != nil {
-					err := msg.SaveToDB(helper)
-					if err != nil {
-						log.Error(err)
-					} else {
-						//_DB.NumDBMsgStored++
-					}
+	select {
+	case <-done:
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Error("database flush deadline reached, ", len(h.DBMsgChan), " messages left")
+		// the messages left are kept on the spool for the next run
+		left := uint64(0)
+	SPOOL:
+		for {
+			select {
+			case item, ok := <-h.DBMsgChan:
+				if !ok {
+					break SPOOL
 				}
+				if item.Msg == nil {
+					continue
+				}
+				if spoolMessage(item.Msg) {
+					atomic.AddUint64(&h.Stat.NumDBMsgSpooled, 1)
+				} else {
+					left++
+				}
+			default:
+				break SPOOL
 			}
-		}()
+		}
+		atomic.AddUint64(&h.Stat.NumDBMsgDropped, left)
+	}
+	if _Spool != nil {
+		_Spool.Close(deadline)
 	}
 
-	//
-	return helper
+	flushed = atomic.LoadUint64(&h.Stat.NumDBMsgStored) - stored
+	dropped = atomic.LoadUint64(&h.Stat.NumDBMsgFailed) - failed +
+		atomic.LoadUint64(&h.Stat.NumDBMsgDropped) - dropped0
+	return
 }
 
+// store a position, on failure it's spooled and ErrSpooled is returned if
+// the database is unreachable. a capturing helper only collects it
 func SaveToDB(imei, lat, lon, speed, heading string, ts int64, dbhelper *DbHelper) error {
-	log.Debug("called DBHELPER.SAVETODB")
-	id, err := GetIdByImei(imei)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
+	return SaveEvent(&Position{Imei: imei, Lat: lat, Lon: lon, Speed: speed, Heading: heading, Ts: ts}, dbhelper)
+}
 
-	sqlStr := `INSERT INTO eventdata(deviceId, timestamp, 
-	     latitude, longitude, speed, heading) VALUES(?,?,?,?,?,?)`
-	stmt, err := _DB.Prepare(sqlStr)
-	if err != nil {
-		return err
+// same as SaveToDB, for the positions with an event. a low battery raises
+// one more once the position is stored
+func SaveEvent(p *Position, dbhelper *DbHelper) error {
+	if dbhelper != nil && dbhelper.capturing {
+		dbhelper.captured = append(dbhelper.captured, p)
+		return nil
 	}
 
-	defer stmt.Close()
-	_, err = stmt.Exec(id, ts, lat, lon, speed, heading)
-	if err != nil {
-		return err
+	err := savePosition(p, false)
+	if err != nil && Retryable(err) && _Spool != nil && _Spool.Put(p) {
+		log.Debug("spooled: ", p, ", ", err)
+		return ErrSpooled
 	}
+	return err
+}
 
-	if lat == "0" && lon == "0" {
-		stmt2, err := _DB.Prepare(`UPDATE devicelatestdata SET lastAckTime=?, 
-		speed=?, heading=?, gpsTimestamp=?, updateTime=? where deviceId=?`)
-		if err != nil {
-			return err
-		}
-		defer stmt2.Close()
-
-		_, err = stmt2.Exec(ts, speed, heading, ts, ts, id)
-		if err != nil {
-			return err
-		}
+func replayPosition(p *Position) error {
+	return savePosition(p, true)
+}
 
-	} else {
-		stmt2, err := _DB.Prepare(`UPDATE devicelatestdata SET lastAckTime=?, 
-	    latitude=?, longitude=?, speed=?, heading=?, gpsTimestamp=?, updateTime=? where deviceId=?`)
-		if err != nil {
-			return err
+// errors that may go away once the database is reachable again
+func Retryable(err error) bool {
+	if err == nil || err == sql.ErrNoRows || err == ErrDeviceRejected || err == ErrDevicePending {
+		return false
+	}
+	// the device lookups are on _DB, the positions on the storage
+	if _Dialect != nil {
+		if known, retry := _Dialect.classify(err); known {
+			return retry
 		}
-		defer stmt2.Close()
+	}
+	if _Storage != nil {
+		return _Storage.Retryable(err)
+	}
+	return true
+}
 
-		_, err = stmt2.Exec(ts, lat, lon, speed, heading, ts, ts, id)
-		if err != nil {
-			return err
-		}
+// store one position, without batching
+func savePosition(p *Position, replay bool) error {
+	log.Debug("called DBHELPER.SAVETODB")
+	id, err := LookupDevice(p.Imei, "", nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 
+	ids, rows := []string{id}, []*Position{p}
+	if err := _Storage.SavePositions(ids, rows, replay); err != nil {
+		return err
 	}
+	raiseLowBatteries(ids, rows)
 	return nil
 }
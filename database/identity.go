@@ -0,0 +1,203 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_IDENTITY_TTL     = 10 * time.Minute
+	DEFAULT_IDENTITY_NEG_TTL = time.Minute
+)
+
+// identity cache statistics
+type IdentityStat struct {
+	Size, Negative             int
+	Hits, NegativeHits, Misses uint64
+	Invalidated, Expired       uint64
+	TTL, NegativeTTL           string
+}
+
+// a cached imei <-> device id pair, id or imei is empty for an unknown one
+type identity struct {
+	id, imei string
+	expires  time.Time
+}
+
+// imei <-> device id of the device table, entries expire after the ttl so
+// the re-assigned or deleted devices are picked up. unknown imeis and ids
+// are cached for negTTL, not to query the database on every packet
+type identityCache struct {
+	lock      sync.RWMutex
+	byImei    map[string]*identity
+	byId      map[string]*identity
+	ttl       time.Duration
+	negTTL    time.Duration
+	lastSweep time.Time
+
+	hits, negHits, misses, invalidated, expired uint64
+}
+
+func newIdentityCache(ttl, negTTL time.Duration) *identityCache {
+	if ttl <= 0 {
+		ttl = DEFAULT_IDENTITY_TTL
+	}
+	if negTTL <= 0 {
+		negTTL = DEFAULT_IDENTITY_NEG_TTL
+	}
+	return &identityCache{byImei: make(map[string]*identity), byId: make(map[string]*identity),
+		ttl: ttl, negTTL: negTTL, lastSweep: time.Now()}
+}
+
+// found is false on a miss, the entry is then to be loaded. an empty id is
+// a cached unknown imei
+func (c *identityCache) getId(imei string) (id string, found bool) {
+	return c.get(c.byImei, imei, func(e *identity) string { return e.id })
+}
+
+func (c *identityCache) getImei(id string) (imei string, found bool) {
+	return c.get(c.byId, id, func(e *identity) string { return e.imei })
+}
+
+func (c *identityCache) get(m map[string]*identity, key string, val func(*identity) string) (string, bool) {
+	c.lock.RLock()
+	e, ok := m[key]
+	c.lock.RUnlock()
+	if !ok || time.Now().After(e.expires) {
+		atomic.AddUint64(&c.misses, 1)
+		return "", false
+	}
+	v := val(e)
+	if v == "" {
+		atomic.AddUint64(&c.negHits, 1)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return v, true
+}
+
+// cache a device, replacing the old pairs of its id and imei
+func (c *identityCache) put(id, imei string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sweep()
+	c.remove(imei, id)
+	e := &identity{id: id, imei: imei, expires: time.Now().Add(c.ttl)}
+	c.byImei[imei] = e
+	c.byId[id] = e
+}
+
+// cache an unknown imei or id
+func (c *identityCache) putMissingImei(imei string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sweep()
+	c.remove(imei, "")
+	c.byImei[imei] = &identity{imei: imei, expires: time.Now().Add(c.negTTL)}
+}
+
+func (c *identityCache) putMissingId(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sweep()
+	c.remove("", id)
+	c.byId[id] = &identity{id: id, expires: time.Now().Add(c.negTTL)}
+}
+
+// remove the entries of the imei and the id, with their pairs. lock held
+func (c *identityCache) remove(imei, id string) int {
+	n := 0
+	if e, ok := c.byImei[imei]; ok {
+		delete(c.byImei, imei)
+		if e.id != "" && c.byId[e.id] == e {
+			delete(c.byId, e.id)
+		}
+		n++
+	}
+	if e, ok := c.byId[id]; ok {
+		delete(c.byId, id)
+		if e.imei != "" && c.byImei[e.imei] == e {
+			delete(c.byImei, e.imei)
+		}
+		n++
+	}
+	return n
+}
+
+// drop the expired entries once per negTTL at most, lock held
+func (c *identityCache) sweep() {
+	now := time.Now()
+	if now.Sub(c.lastSweep) < c.negTTL {
+		return
+	}
+	c.lastSweep = now
+	for k, e := range c.byImei {
+		if now.After(e.expires) {
+			delete(c.byImei, k)
+			c.expired++
+		}
+	}
+	for k, e := range c.byId {
+		if now.After(e.expires) {
+			delete(c.byId, k)
+			if e.imei == "" {
+				c.expired++
+			}
+		}
+	}
+}
+
+// invalidate an imei or a device id, false if neither is cached
+func (c *identityCache) invalidate(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.remove(key, key)
+	c.invalidated += uint64(n)
+	return n > 0
+}
+
+// returns the num of entries invalidated
+func (c *identityCache) invalidateAll() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.byImei)
+	for _, e := range c.byId {
+		if e.imei == "" {
+			n++
+		}
+	}
+	c.byImei = make(map[string]*identity)
+	c.byId = make(map[string]*identity)
+	c.invalidated += uint64(n)
+	return n
+}
+
+func (c *identityCache) stat() IdentityStat {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := IdentityStat{
+		Hits:         atomic.LoadUint64(&c.hits),
+		NegativeHits: atomic.LoadUint64(&c.negHits),
+		Misses:       atomic.LoadUint64(&c.misses),
+		Invalidated:  c.invalidated,
+		Expired:      c.expired,
+		TTL:          c.ttl.String(),
+		NegativeTTL:  c.negTTL.String(),
+	}
+	for _, e := range c.byImei {
+		if e.id == "" {
+			ret.Negative++
+		} else {
+			ret.Size++
+		}
+	}
+	for _, e := range c.byId {
+		if e.imei == "" {
+			ret.Negative++
+		}
+	}
+	return ret
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentityCache(t *testing.T) {
+	c := newIdentityCache(time.Hour, time.Hour)
+	if _, ok := c.getId("111"); ok {
+		t.Fatal("expected a miss")
+	}
+	c.put("1", "111")
+	if id, ok := c.getId("111"); !ok || id != "1" {
+		t.Fatal("unexpected id:", id, ok)
+	}
+	if imei, ok := c.getImei("1"); !ok || imei != "111" {
+		t.Fatal("unexpected imei:", imei, ok)
+	}
+
+	// re-assigned to another device
+	c.put("2", "111")
+	if _, ok := c.getImei("1"); ok {
+		t.Fatal("expected the old id dropped")
+	}
+
+	c.putMissingImei("999")
+	if id, ok := c.getId("999"); !ok || id != "" {
+		t.Fatal("expected a negative hit:", id, ok)
+	}
+	stat := c.stat()
+	if stat.Size != 1 || stat.Negative != 1 || stat.Hits != 2 || stat.NegativeHits != 1 || stat.Misses != 2 {
+		t.Fatal("unexpected stat:", stat)
+	}
+
+	if !c.invalidate("2") || c.invalidate("2") {
+		t.Fatal("unexpected invalidation")
+	}
+	if _, ok := c.getId("111"); ok {
+		t.Fatal("expected the pair dropped")
+	}
+	if c.invalidateAll() != 1 || c.stat().Negative != 0 {
+		t.Fatal("unexpected stat:", c.stat())
+	}
+}
+
+func TestIdentityCacheExpiry(t *testing.T) {
+	c := newIdentityCache(10*time.Millisecond, 10*time.Millisecond)
+	c.put("1", "111")
+	c.putMissingImei("999")
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.getId("111"); ok {
+		t.Fatal("expected expired")
+	}
+	c.put("2", "222")
+	if stat := c.stat(); stat.Size != 1 || stat.Negative != 0 || stat.Expired != 2 {
+		t.Fatal("expected swept:", stat)
+	}
+}
+
+func TestIdentityCacheConcurrent(t *testing.T) {
+	c := newIdentityCache(time.Hour, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				k := strconv.Itoa(j % 50)
+				if _, ok := c.getId(k); !ok {
+					c.put(k, k)
+				}
+				if j%100 == 0 {
+					c.invalidate(k)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,263 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// applied migrations, one row per version
+const SCHEMA_VERSION_TABLE = "schema_version"
+
+// a schema change, the statements are run in order. mysql commits the
+// ddl statements right away, a failed migration may have to be cleaned up
+// by hand there
+type migration struct {
+	version int
+	desc    string
+	up      func(d *dialect) []string
+}
+
+// append only, the versions are never reused
+var _Migrations = []migration{
+	{1, "device, event, latest data and command tables", func(d *dialect) []string {
+		ret := make([]string, 0)
+		ret = append(ret, createTable(d, "device", `id `+d.autoId+`,
+		deviceImei VARCHAR(32) NOT NULL UNIQUE`)...)
+		ret = append(ret, createTable(d, "eventdata", `id `+d.autoId+`,
+		deviceId INT NOT NULL,
+		timestamp BIGINT NOT NULL,
+		latitude DECIMAL(10,6),
+		longitude DECIMAL(10,6),
+		speed DECIMAL(8,2),
+		heading DECIMAL(8,2)`, "idx_eventdata_device(deviceId, timestamp)")...)
+		ret = append(ret, createTable(d, "devicelatestdata", `deviceId INT NOT NULL PRIMARY KEY,
+		lastAckTime BIGINT,
+		latitude DECIMAL(10,6),
+		longitude DECIMAL(10,6),
+		speed DECIMAL(8,2),
+		heading DECIMAL(8,2),
+		gpsTimestamp BIGINT,
+		updateTime BIGINT`)...)
+		ret = append(ret, createTable(d, "commandtypes", `id `+d.autoId+`,
+		type VARCHAR(32) NOT NULL UNIQUE`)...)
+		ret = append(ret, createTable(d, "commands", `id `+d.autoId+`,
+		deviceId INT NOT NULL,
+		type INT NOT NULL,
+		params VARCHAR(255),
+		status VARCHAR(16) NOT NULL DEFAULT 'PENDING'`, "idx_commands_status(status, deviceId)")...)
+		return ret
+	}},
+	{2, "command types", func(d *dialect) []string {
+		return []string{
+			insertIgnore(d, "commandtypes", "type", "'"+CMD_TYPE_REPINTV+"'"),
+			insertIgnore(d, "commandtypes", "type", "'"+CMD_TYPE_SRVADDR+"'"),
+		}
+	}},
+	{3, "pending devices and device owners", func(d *dialect) []string {
+		ret := createTable(d, "pending_devices", `imei VARCHAR(32) NOT NULL PRIMARY KEY,
+		vendor VARCHAR(32),
+		remoteAddr VARCHAR(64),
+		firstSeen BIGINT NOT NULL,
+		lastSeen BIGINT NOT NULL,
+		numPackets BIGINT NOT NULL DEFAULT 0`)
+		return append(ret, "ALTER TABLE device ADD COLUMN ownerId INT")
+	}},
+	{4, "command queue: priorities, expiry and retries", func(d *dialect) []string {
+		ret := make([]string, 0)
+		for _, v := range []string{
+			"priority INT NOT NULL DEFAULT 0",
+			"createTime BIGINT",
+			"expireTime BIGINT",
+			"maxAttempts INT NOT NULL DEFAULT 3",
+			"attempts INT NOT NULL DEFAULT 0",
+			"retryIntervalSec INT NOT NULL DEFAULT 60",
+			"lastSentTime BIGINT",
+			"updateTime BIGINT",
+		} {
+			ret = append(ret, "ALTER TABLE commands ADD COLUMN "+v)
+		}
+		return ret
+	}},
+	{5, "command status history", func(d *dialect) []string {
+		return createTable(d, "command_history", `id `+d.autoId+`,
+		commandId INT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		updateTime BIGINT`, "idx_command_history(commandId, id)")
+	}},
+	{6, "working mode command type", func(d *dialect) []string {
+		return []string{insertIgnore(d, "commandtypes", "type", "'"+CMD_TYPE_WORKMODE+"'")}
+	}},
+	{7, "gl500 command types and device passwords", func(d *dialect) []string {
+		ret := []string{"ALTER TABLE device ADD COLUMN password VARCHAR(16)"}
+		for _, v := range []string{CMD_TYPE_GTBSI, CMD_TYPE_GTSRI, CMD_TYPE_GTTMA, CMD_TYPE_GTGBC, CMD_TYPE_GTGEO} {
+			ret = append(ret, insertIgnore(d, "commandtypes", "type", "'"+v+"'"))
+		}
+		return ret
+	}},
+	{8, "event types of the positions", func(d *dialect) []string {
+		return []string{
+			"ALTER TABLE eventdata ADD COLUMN eventType VARCHAR(16)",
+			"ALTER TABLE eventdata ADD COLUMN eventData VARCHAR(255)",
+		}
+	}},
+	{9, "backfilled positions", func(d *dialect) []string {
+		return []string{"ALTER TABLE eventdata ADD COLUMN backfill SMALLINT NOT NULL DEFAULT 0"}
+	}},
+	{10, "device status flags of the positions", func(d *dialect) []string {
+		return []string{"ALTER TABLE eventdata ADD COLUMN flags VARCHAR(128)"}
+	}},
+	{11, "battery of the positions and of the latest data", func(d *dialect) []string {
+		ret := make([]string, 0)
+		for _, t := range []string{"eventdata", "devicelatestdata"} {
+			ret = append(ret, "ALTER TABLE "+t+" ADD COLUMN batteryLevel SMALLINT",
+				"ALTER TABLE "+t+" ADD COLUMN batteryVoltage DECIMAL(6,3)")
+		}
+		return ret
+	}},
+	{12, "vendors of the devices", func(d *dialect) []string {
+		return []string{"ALTER TABLE device ADD COLUMN vendor VARCHAR(32)"}
+	}},
+	{13, "gl500 continuous report command types", func(d *dialect) []string {
+		return []string{
+			insertIgnore(d, "commandtypes", "type", "'"+CMD_TYPE_GTCTN+"'"),
+			insertIgnore(d, "commandtypes", "type", "'"+CMD_TYPE_GTFRI+"'"),
+		}
+	}},
+	{14, "low battery flags of the devices", func(d *dialect) []string {
+		return []string{"ALTER TABLE devicelatestdata ADD COLUMN batteryLow SMALLINT"}
+	}},
+}
+
+// schema version expected by the binary
+func LatestSchemaVersion() int {
+	return _Migrations[len(_Migrations)-1].version
+}
+
+// the tables are kept if they exist, so the schema of an older deployment is
+// adopted. mysql has no "create index if not exists", its indexes are
+// declared in the table
+func createTable(d *dialect, table, cols string, indexes ...string) []string {
+	if d.name == "mysql" {
+		for _, v := range indexes {
+			cols += ",\n\t\tINDEX " + v
+		}
+		return []string{"CREATE TABLE IF NOT EXISTS " + table + " (\n\t\t" + cols + ")"}
+	}
+	ret := []string{"CREATE TABLE IF NOT EXISTS " + table + " (\n\t\t" + cols + ")"}
+	for _, v := range indexes {
+		i := strings.Index(v, "(")
+		ret = append(ret, "CREATE INDEX IF NOT EXISTS "+v[:i]+" ON "+table+v[i:])
+	}
+	return ret
+}
+
+// insert a row unless it violates a unique key
+func insertIgnore(d *dialect, table, cols, values string) string {
+	if d.name == "mysql" {
+		return "INSERT IGNORE INTO " + table + "(" + cols + ") VALUES (" + values + ")"
+	}
+	return "INSERT INTO " + table + "(" + cols + ") VALUES (" + values + ") ON CONFLICT DO NOTHING"
+}
+
+// current version of the schema, 0 if it's never been migrated
+func schemaVersion(db *sql.DB, d *dialect) (int, error) {
+	var v sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM " + SCHEMA_VERSION_TABLE).Scan(&v)
+	if err != nil {
+		if known, retry := d.classify(err); known && !retry {
+			// no such table
+			return 0, nil
+		}
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// migrate the database of the driver up to the target version, 0 for the
+// latest. returns the versions before and after
+func Migrate(driver, dsn string, target int) (from, to int, err error) {
+	d, err := getDialect(driver)
+	if err != nil {
+		return 0, 0, err
+	}
+	db, err := sql.Open(d.name, dsn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	return migrate(db, d, target)
+}
+
+func migrate(db *sql.DB, d *dialect, target int) (from, to int, err error) {
+	if target <= 0 {
+		target = LatestSchemaVersion()
+	}
+	if target > LatestSchemaVersion() {
+		return 0, 0, fmt.Errorf("unknown schema version %d, the latest is %d", target, LatestSchemaVersion())
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + SCHEMA_VERSION_TABLE + ` (
+		version INT NOT NULL PRIMARY KEY,
+		description VARCHAR(255),
+		appliedAt BIGINT)`)
+	if err != nil {
+		return 0, 0, err
+	}
+	from, err = schemaVersion(db, d)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to = from
+	for _, m := range _Migrations {
+		if m.version <= from || m.version > target {
+			continue
+		}
+		log.Info("migrating to schema version ", m.version, ": ", m.desc)
+		tx, err := db.Begin()
+		if err != nil {
+			return from, to, err
+		}
+		for _, q := range m.up(d) {
+			if _, err := tx.Exec(q); err != nil {
+				tx.Rollback()
+				return from, to, fmt.Errorf("schema version %d: %v, %s", m.version, err, q)
+			}
+		}
+		_, err = tx.Exec(d.rebind("INSERT INTO "+SCHEMA_VERSION_TABLE+"(version, description, appliedAt) VALUES (?,?,?)"),
+			m.version, m.desc, time.Now().UnixNano()/1000000)
+		if err != nil {
+			tx.Rollback()
+			return from, to, err
+		}
+		if err := tx.Commit(); err != nil {
+			return from, to, err
+		}
+		to = m.version
+	}
+	return from, to, nil
+}
+
+// the server refuses to start on a schema older than the binary expects,
+// `lbsas migrate` upgrades it. an unreachable database is left to the spool
+func CheckSchema() error {
+	v, err := schemaVersion(_DB, _Dialect)
+	if err != nil {
+		log.Warn("can't check the schema version: ", err)
+		return nil
+	}
+	latest := LatestSchemaVersion()
+	if v < latest {
+		return fmt.Errorf("schema version %d is older than %d, run `lbsas migrate` first", v, latest)
+	}
+	if v > latest {
+		log.Warn("schema version ", v, " is newer than ", latest, ", the binary may be outdated")
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, _ := getDialect("sqlite3")
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if v, err := schemaVersion(db, d); err != nil || v != 0 {
+		t.Fatal("unexpected version:", v, err)
+	}
+	if from, to, err := migrate(db, d, 1); err != nil || from != 0 || to != 1 {
+		t.Fatal("unexpected migration:", from, to, err)
+	}
+	if from, to, err := migrate(db, d, 0); err != nil || from != 1 || to != LatestSchemaVersion() {
+		t.Fatal("unexpected migration:", from, to, err)
+	}
+	if from, to, err := migrate(db, d, 0); err != nil || from != to {
+		t.Fatal("expected no migration:", from, to, err)
+	}
+	if _, _, err := migrate(db, d, LatestSchemaVersion()+1); err == nil {
+		t.Fatal("expected an error for an unknown version")
+	}
+
+	var n int
+	if err := db.QueryRow("select count(*) from commandtypes").Scan(&n); err != nil || n != 10 {
+		t.Fatal("unexpected command types:", n, err)
+	}
+	if _, err := db.Exec("insert into devicelatestdata(deviceId) values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	s := newSQLStorage(db, d)
+	if err := s.SavePositions([]string{"1"}, []*Position{{Lat: "30.1", Lon: "120.1", Speed: "1", Heading: "2", Ts: 1}}, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	my, _ := getDialect("mysql")
+	q := createTable(my, "t", "id INT", "idx_t(id)")
+	if len(q) != 1 || !strings.Contains(q[0], "INDEX idx_t(id)") {
+		t.Fatal("unexpected mysql table:", q)
+	}
+	pg, _ := getDialect("postgres")
+	q = createTable(pg, "t", "id INT", "idx_t(id)")
+	if len(q) != 2 || q[1] != "CREATE INDEX IF NOT EXISTS idx_t ON t(id)" {
+		t.Fatal("unexpected postgres table:", q)
+	}
+}
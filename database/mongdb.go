@@ -5,3 +5,239 @@
 //
 
 package database
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	MONGO_DIAL_TIMEOUT = 10 * time.Second
+	// one document per position
+	MONGO_EVENTS = "eventdata"
+	// one document per device, _id is the device id
+	MONGO_LATEST = "devicelatestdata"
+)
+
+// GeoJSON point
+type geoPoint struct {
+	Type        string     `bson:"type"`
+	Coordinates [2]float64 `bson:"coordinates"`
+}
+
+type mongoEvent struct {
+	DeviceId  string    `bson:"deviceId"`
+	Imei      string    `bson:"imei"`
+	Timestamp int64     `bson:"timestamp"`
+	Time      time.Time `bson:"time"`
+	Loc       *geoPoint `bson:"loc,omitempty"`
+	Speed     float64   `bson:"speed"`
+	Heading   float64   `bson:"heading"`
+	Event     string    `bson:"event,omitempty"`
+	Data      string    `bson:"data,omitempty"`
+	Backfill  bool      `bson:"backfill,omitempty"`
+	Flags     string    `bson:"flags,omitempty"`
+	Battery   *float64  `bson:"battery,omitempty"`
+	Voltage   *float64  `bson:"voltage,omitempty"`
+}
+
+// positions stored into mongodb, the device ids still come from the sql
+// database. the points are GeoJSON with a 2dsphere index, a position without
+// location has no loc
+type mongoStorage struct {
+	session *mgo.Session
+}
+
+// url: mongodb://127.0.0.1:27017/cargts
+func newMongoStorage(url string) (*mongoStorage, error) {
+	session, err := mgo.DialWithTimeout(url, MONGO_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mgo.Monotonic, true)
+	session.SetSafe(&mgo.Safe{})
+
+	s := &mongoStorage{session: session}
+	if err := s.ensureIndexes(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *mongoStorage) ensureIndexes() error {
+	db := s.session.DB("")
+	indexes := []struct {
+		c   string
+		idx mgo.Index
+	}{
+		{MONGO_EVENTS, mgo.Index{Key: []string{"$2dsphere:loc"}}},
+		{MONGO_EVENTS, mgo.Index{Key: []string{"deviceId", "timestamp"}}},
+		{MONGO_LATEST, mgo.Index{Key: []string{"$2dsphere:loc"}}},
+	}
+	for _, v := range indexes {
+		if err := db.C(v.c).EnsureIndex(v.idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStorage) Name() string {
+	return STORAGE_MONGO
+}
+
+// the events by one unordered bulk insert, then one upsert of the latest
+// data per device
+func (s *mongoStorage) SavePositions(ids []string, rows []*Position, replay bool) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	session := s.session.Copy()
+	defer session.Close()
+	db := session.DB("")
+
+	docs := make([]interface{}, len(rows))
+	for i, p := range rows {
+		docs[i] = &mongoEvent{
+			DeviceId:  ids[i],
+			Imei:      p.Imei,
+			Timestamp: p.Ts,
+			Time:      time.Unix(0, p.Ts*int64(time.Millisecond)),
+			Loc:       pointOf(p),
+			Speed:     parseFloat(p.Speed),
+			Heading:   parseFloat(p.Heading),
+			Event:     p.Event,
+			Data:      p.Data,
+			Backfill:  p.Backfill,
+			Flags:     p.Flags,
+			Battery:   optFloat(p.Battery),
+			Voltage:   optFloat(p.Voltage),
+		}
+	}
+	bulk := db.C(MONGO_EVENTS).Bulk()
+	bulk.Unordered()
+	bulk.Insert(docs...)
+	if _, err := bulk.Run(); err != nil {
+		berr, ok := err.(*mgo.BulkError)
+		if !ok || s.Retryable(err) {
+			return err
+		}
+		// unordered, only the documents of the cases are left out, a retry
+		// would duplicate the others
+		for _, c := range berr.Cases() {
+			if c.Index >= 0 && c.Index < len(rows) {
+				log.Error("mongo: event not stored: ", rows[c.Index], ", ", c.Err)
+			} else {
+				log.Error("mongo: event not stored: ", c.Err)
+			}
+		}
+	}
+
+	for id, p := range latestOf(ids, rows) {
+		if err := updateLatestDoc(db.C(MONGO_LATEST), id, p, replay || p.Backfill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// same as updateLatest of the sql storage, the document is created on the
+// first position of the device
+func updateLatestDoc(c *mgo.Collection, id string, p *Position, replay bool) error {
+	set := bson.M{"lastAckTime": p.Ts, "updateTime": p.Ts}
+	since := "gpsTimestamp"
+	if p.NoGPS {
+		since = "lastAckTime"
+	} else {
+		set["speed"], set["heading"], set["gpsTimestamp"] = parseFloat(p.Speed), parseFloat(p.Heading), p.Ts
+		if loc := pointOf(p); loc != nil {
+			set["loc"] = loc
+		}
+	}
+	if v := optFloat(p.Battery); v != nil {
+		set["battery"] = *v
+	}
+	if v := optFloat(p.Voltage); v != nil {
+		set["voltage"] = *v
+	}
+	sel := bson.M{"_id": id}
+	if replay {
+		sel["$or"] = []bson.M{{since: bson.M{"$exists": false}}, {since: bson.M{"$lt": p.Ts}}}
+	}
+	_, err := c.Upsert(sel, bson.M{"$set": set})
+	if replay && mgo.IsDup(err) {
+		// the latest data is newer
+		return nil
+	}
+	return err
+}
+
+func (s *mongoStorage) Retryable(err error) bool {
+	if err == nil || err == mgo.ErrNotFound || mgo.IsDup(err) {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.BulkError:
+		// network errors are reported for every document of the bulk
+		for _, c := range e.Cases() {
+			if s.Retryable(c.Err) {
+				return true
+			}
+		}
+		return false
+	case *mgo.LastError, *mgo.QueryError:
+		return false
+	}
+	// no reachable servers, closed sockets...
+	return true
+}
+
+func (s *mongoStorage) Close() error {
+	s.session.Close()
+	return nil
+}
+
+// GeoJSON point of a position, nil if it has no location
+func pointOf(p *Position) *geoPoint {
+	if p.NoGPS || (p.Lat == "0" && p.Lon == "0") {
+		return nil
+	}
+	lat, err := strconv.ParseFloat(p.Lat, 64)
+	if err != nil {
+		log.Debug("invalid latitude: ", p)
+		return nil
+	}
+	lon, err := strconv.ParseFloat(p.Lon, 64)
+	if err != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		log.Debug("invalid location: ", p)
+		return nil
+	}
+	return &geoPoint{"Point", [2]float64{lon, lat}}
+}
+
+func parseFloat(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// nil if not reported
+func optFloat(s string) *float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
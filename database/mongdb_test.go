@@ -0,0 +1,58 @@
+package database
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// against a local mongod, like LBSAS_MONGO_URL=mongodb://127.0.0.1:27017
+func TestMongoStorage(t *testing.T) {
+	url := os.Getenv("LBSAS_MONGO_URL")
+	if url == "" {
+		t.Skip("LBSAS_MONGO_URL not set")
+	}
+	s, err := newMongoStorage(url + "/lbsas_test_" + strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	db := s.session.DB("")
+	defer db.DropDatabase()
+
+	rows := []*Position{
+		{Imei: "1", Lat: "30.1", Lon: "120.1", Speed: "1", Heading: "90", Ts: 10},
+		{Imei: "1", Lat: "30.2", Lon: "120.2", Speed: "2", Heading: "90", Ts: 20},
+		{Imei: "2", Lat: "0", Lon: "0", Speed: "3", Heading: "90", Ts: 15},
+	}
+	if err := s.SavePositions([]string{"1", "1", "2"}, rows, false); err != nil {
+		t.Fatal(err)
+	}
+	// older than the latest data, only the event is stored
+	if err := s.SavePositions([]string{"1"}, []*Position{{Imei: "1", Lat: "29", Lon: "119", Ts: 5}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.C(MONGO_EVENTS).Count(); err != nil || n != 4 {
+		t.Fatal("unexpected events:", n, err)
+	}
+	// the 2dsphere index is used by $near
+	near := bson.M{"loc": bson.M{"$near": bson.M{"$geometry": geoPoint{"Point", [2]float64{120.2, 30.2}},
+		"$maxDistance": 100}}}
+	var ev mongoEvent
+	if err := db.C(MONGO_EVENTS).Find(near).One(&ev); err != nil || ev.Timestamp != 20 {
+		t.Fatal("unexpected near event:", ev, err)
+	}
+
+	latest := bson.M{}
+	if err := db.C(MONGO_LATEST).FindId("1").One(&latest); err != nil || latest["gpsTimestamp"] != int64(20) {
+		t.Fatal("unexpected latest data:", latest, err)
+	}
+	latest = bson.M{}
+	if err := db.C(MONGO_LATEST).FindId("2").One(&latest); err != nil || latest["loc"] != nil {
+		t.Fatal("unexpected latest data:", latest, err)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"github.com/go-sql-driver/mysql"
+)
+
+// user:password@tcp(127.0.0.1:3306)/hello
+func init() {
+	registerDialect(&dialect{name: "mysql", autoId: "INT NOT NULL AUTO_INCREMENT PRIMARY KEY",
+		classify: mysqlClassify})
+}
+
+func mysqlClassify(err error) (known, retry bool) {
+	e, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false, false
+	}
+	switch e.Number {
+	// too many connections, lock wait timeout, deadlock, read only
+	case 1040, 1205, 1213, 1290, 1836:
+		return true, true
+	}
+	return true, false
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// vendor specific function to write the pending commands of the device
+// onto its session, true if any command has been sent
+type CmdSender func(sess *Session) bool
+
+// a live device connection, tcp Conn or udp UdpConn + Remote. Sender and
+// Acks are replaced by the uplinks of the registered session, they're read
+// through cmdSender once registered
+type Session struct {
+	Imei, DeviceId, Vendor string
+	Conn                   net.Conn
+	UdpConn                *net.UDPConn
+	Remote                 *net.UDPAddr
+	Since                  time.Time
+	Sender                 CmdSender
+	// the device acks the commands, they are kept until acked
+	Acks bool
+
+	// serialize command deliveries on the session
+	lock sync.Mutex
+	// guards lastSeen, Sender and Acks
+	state    sync.Mutex
+	lastSeen time.Time
+}
+
+// imei -> live session, and the imeis on the tcp connections, guarded by
+// _SessionsLock
+var _Sessions = make(map[string]*Session)
+var _ConnImeis = make(map[net.Conn]map[string]bool)
+var _SessionsLock sync.RWMutex
+
+// udp has no connection, a session expires without uplinks in this duration
+var _SessionTimeout = 90 * time.Second
+
+func (s *Session) Write(b []byte) (int, error) {
+	if s.Conn != nil {
+		return s.Conn.Write(b)
+	}
+	return s.UdpConn.WriteToUDP(b, s.Remote)
+}
+
+func (s *Session) RemoteAddr() string {
+	if s.Conn != nil {
+		return s.Conn.RemoteAddr().String()
+	}
+	return s.Remote.String()
+}
+
+func (s *Session) LocalAddr() string {
+	if s.Conn != nil {
+		return s.Conn.LocalAddr().String()
+	}
+	return s.UdpConn.LocalAddr().String()
+}
+
+// time of the last uplink
+func (s *Session) LastSeen() time.Time {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.lastSeen
+}
+
+func (s *Session) cmdSender() (CmdSender, bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.Sender, s.Acks
+}
+
+// an uplink on the registered session
+func (s *Session) seen(now time.Time, sender CmdSender, acks bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	s.lastSeen, s.Sender, s.Acks = now, sender, acks
+}
+
+func (s *Session) alive() bool {
+	return s.Conn != nil || time.Now().Sub(s.LastSeen()) < _SessionTimeout
+}
+
+func (s *Session) sameConn(o *Session) bool {
+	if s.Conn != nil || o.Conn != nil {
+		return s.Conn == o.Conn
+	}
+	return s.Remote.String() == o.Remote.String()
+}
+
+// write the pending commands of the device right away
+func (s *Session) DeliverCmds() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sender, _ := s.cmdSender()
+	if sender == nil {
+		return false
+	}
+	return sender(s)
+}
+
+// register the session of a device on uplink, the registered one is
+// returned if the device is still on the same connection
+func Online(sess *Session) *Session {
+	_SessionsLock.Lock()
+	defer _SessionsLock.Unlock()
+
+	now := time.Now()
+	old, ok := _Sessions[sess.Imei]
+	if ok && old.sameConn(sess) {
+		old.seen(now, sess.Sender, sess.Acks)
+		return old
+	} else if ok && old.alive() {
+		log.Info("device reconnected: ", sess.Imei, ", from ", old.RemoteAddr(), " to ", sess.RemoteAddr())
+	}
+
+	if ok {
+		unindex(old)
+	}
+	sess.Since, sess.lastSeen = now, now
+	_Sessions[sess.Imei] = sess
+	if sess.Conn != nil {
+		if _ConnImeis[sess.Conn] == nil {
+			_ConnImeis[sess.Conn] = make(map[string]bool)
+		}
+		_ConnImeis[sess.Conn][sess.Imei] = true
+	}
+	log.Debug("device online: ", sess.Imei, ", ", sess.RemoteAddr())
+	go confirmReconnect(sess)
+	return sess
+}
+
+// drop the session from the connection index
+func unindex(sess *Session) {
+	if imeis := _ConnImeis[sess.Conn]; imeis != nil {
+		delete(imeis, sess.Imei)
+		if len(imeis) == 0 {
+			delete(_ConnImeis, sess.Conn)
+		}
+	}
+}
+
+// unregister the sessions on a closed tcp connection
+func Offline(conn net.Conn) {
+	_SessionsLock.Lock()
+	defer _SessionsLock.Unlock()
+	for k := range _ConnImeis[conn] {
+		delete(_Sessions, k)
+		log.Debug("device offline: ", k)
+	}
+	delete(_ConnImeis, conn)
+}
+
+// unregister the udp sessions without uplinks in time, returns the num
+// of expired ones
+func expireSessions() int {
+	_SessionsLock.Lock()
+	defer _SessionsLock.Unlock()
+	ret := 0
+	for k, v := range _Sessions {
+		if !v.alive() {
+			delete(_Sessions, k)
+			log.Debug("device expired: ", k)
+			ret++
+		}
+	}
+	return ret
+}
+
+// the live session of a device, nil if it's not connected
+func GetSession(imei string) *Session {
+	_SessionsLock.RLock()
+	defer _SessionsLock.RUnlock()
+	if sess, ok := _Sessions[imei]; ok && sess.alive() {
+		return sess
+	}
+	return nil
+}
+
+// all live sessions
+func GetSessions() []*Session {
+	_SessionsLock.RLock()
+	defer _SessionsLock.RUnlock()
+	ret := make([]*Session, 0, len(_Sessions))
+	for _, v := range _Sessions {
+		if v.alive() {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// deliver the pending commands to the device if it's connected
+func DeliverCmds(deviceId string) bool {
+	imei, err := GetImeiById(deviceId)
+	if err != nil {
+		return false
+	}
+	sess := GetSession(imei)
+	if sess == nil {
+		log.Debug("device not connected, cmds deferred: ", imei)
+		return false
+	}
+	return sess.DeliverCmds()
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	defer func() {
+		_Sessions = make(map[string]*Session)
+		_ConnImeis = make(map[net.Conn]map[string]bool)
+	}()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	udp := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9000}
+
+	Online(&Session{Imei: "1", Conn: a})
+	Online(&Session{Imei: "2", Conn: a})
+	Online(&Session{Imei: "3", Conn: b})
+	Online(&Session{Imei: "4", Remote: udp})
+	// reconnected on another connection
+	Online(&Session{Imei: "2", Conn: b})
+
+	Offline(a)
+	if GetSession("1") != nil || GetSession("2") == nil || GetSession("3") == nil {
+		t.Fatal("unexpected sessions:", _Sessions)
+	}
+	if _, ok := _ConnImeis[a]; ok {
+		t.Fatal("unexpected index:", _ConnImeis)
+	}
+
+	if n := expireSessions(); n != 0 {
+		t.Fatal("unexpected expired:", n)
+	}
+	_Sessions["4"].seen(time.Now().Add(-_SessionTimeout), nil, false)
+	if n := expireSessions(); n != 1 || len(_Sessions) != 2 {
+		t.Fatal("unexpected expired:", n, _Sessions)
+	}
+
+	Offline(b)
+	if len(_Sessions) != 0 || len(_ConnImeis) != 0 {
+		t.Fatal("unexpected sessions:", _Sessions, _ConnImeis)
+	}
+}
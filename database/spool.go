@@ -0,0 +1,457 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// a new segment is started beyond this size
+	SPOOL_SEGMENT_SIZE = 8 << 20
+	// the replay position is saved every these records
+	SPOOL_SYNC_RECORDS = 100
+	SPOOL_MIN_BACKOFF  = time.Second
+	SPOOL_MAX_BACKOFF  = 5 * time.Minute
+	SPOOL_OFFSET_FILE  = "offset"
+)
+
+var ErrSpooled = errors.New("database unavailable, message spooled")
+
+// a position to be stored, all the vendor messages end up as one
+type Position struct {
+	Imei    string `json:"imei"`
+	Lat     string `json:"lat"`
+	Lon     string `json:"lon"`
+	Speed   string `json:"speed"`
+	Heading string `json:"heading"`
+	Ts      int64  `json:"ts"`
+	// the report of a device event, e.g. GTGEO, empty for the plain
+	// positions. the details are key=value pairs separated by ';'
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data,omitempty"`
+	// an event without gps data, stored without location, speed and heading
+	NoGPS bool `json:"nogps,omitempty"`
+	// buffered by the device while it was offline, stored at its own time
+	// without overwriting newer latest data
+	Backfill bool `json:"backfill,omitempty"`
+	// the states and alarms of the device, names separated by ','
+	Flags string `json:"flags,omitempty"`
+	// battery percentage and voltage in V, as reported
+	Battery string `json:"battery,omitempty"`
+	Voltage string `json:"voltage,omitempty"`
+}
+
+func (p *Position) SaveToDB(dbhelper *DbHelper) error {
+	return SaveEvent(p, dbhelper)
+}
+
+// spool statistics
+type SpoolStat struct {
+	Depth, Bytes                                    int64
+	NumSpooled, NumReplayed, NumSkipped, NumDropped uint64
+	Backoff, LastError                              string
+	LastReplayTime                                  time.Time
+}
+
+// append-only spool of the positions that can't be stored for now, kept in
+// numbered segment files: <dir>/<seq>.spool, one json record per line.
+// the records are replayed in order once the database is reachable again,
+// the replay position is kept in <dir>/offset
+type Spool struct {
+	dir      string
+	maxBytes int64
+
+	lock  sync.Mutex
+	segs  []uint64
+	w     *os.File
+	wSize int64
+	// replay position in segs[0]
+	rOff  int64
+	depth int64
+	bytes int64
+
+	numSpooled, numReplayed, numSkipped, numDropped uint64
+	backoff                                         time.Duration
+	lastError                                       string
+	lastReplay                                      time.Time
+
+	closed bool
+	notify chan bool
+	stop   chan bool
+	done   chan bool
+}
+
+// open the spool under dir, the records left by a previous run are
+// replayed. maxBytes caps the disk usage, 0 for no cap
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, backoff: SPOOL_MIN_BACKOFF,
+		notify: make(chan bool, 1), stop: make(chan bool), done: make(chan bool)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range files {
+		if !strings.HasSuffix(v.Name(), ".spool") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(v.Name(), ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segs = append(s.segs, seq)
+		s.bytes += v.Size()
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i] < s.segs[j] })
+
+	if len(s.segs) > 0 {
+		s.loadOffset()
+		s.bytes -= s.rOff
+		for i, seq := range s.segs {
+			off := int64(0)
+			if i == 0 {
+				off = s.rOff
+			}
+			n, err := countLines(s.path(seq), off)
+			if err != nil {
+				return nil, err
+			}
+			s.depth += n
+		}
+		log.Warn("spool: ", s.depth, " records left by the previous run in ", dir)
+	}
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.spool", seq))
+}
+
+func countLines(path string, off int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var ret int64
+	r := bufio.NewReader(f)
+	for {
+		_, err := r.ReadBytes('\n')
+		if err != nil {
+			return ret, nil
+		}
+		ret++
+	}
+}
+
+// replay position: "<seq> <offset>"
+func (s *Spool) loadOffset() {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, SPOOL_OFFSET_FILE))
+	if err != nil {
+		return
+	}
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &off); err == nil && seq == s.segs[0] {
+		s.rOff = off
+	}
+}
+
+func (s *Spool) saveOffset() {
+	if len(s.segs) == 0 {
+		os.Remove(filepath.Join(s.dir, SPOOL_OFFSET_FILE))
+		return
+	}
+	tmp := filepath.Join(s.dir, SPOOL_OFFSET_FILE+".tmp")
+	data := fmt.Sprintf("%d %d\n", s.segs[0], s.rOff)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		log.Error("spool: ", err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(s.dir, SPOOL_OFFSET_FILE))
+}
+
+// append a record, false if it's dropped for the disk cap or an error
+func (s *Spool) Put(p *Position) bool {
+	line, err := json.Marshal(p)
+	if err != nil {
+		log.Error("spool: ", err)
+		return false
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || (s.maxBytes > 0 && s.bytes+int64(len(line)) > s.maxBytes) {
+		s.numDropped++
+		if s.numDropped%1000 == 1 {
+			log.Error("spool full or closed, ", s.numDropped, " records dropped")
+		}
+		return false
+	}
+
+	if s.w == nil || s.wSize >= SPOOL_SEGMENT_SIZE {
+		if err := s.rotate(); err != nil {
+			s.numDropped++
+			log.Error("spool: ", err)
+			return false
+		}
+	}
+	if _, err := s.w.Write(line); err != nil {
+		s.numDropped++
+		log.Error("spool: ", err)
+		return false
+	}
+	s.wSize += int64(len(line))
+	s.bytes += int64(len(line))
+	s.depth++
+	s.numSpooled++
+
+	select {
+	case s.notify <- true:
+	default:
+	}
+	return true
+}
+
+// start a new segment for writing
+func (s *Spool) rotate() error {
+	if s.w != nil {
+		s.w.Close()
+	}
+	seq := uint64(1)
+	if len(s.segs) > 0 {
+		seq = s.segs[len(s.segs)-1] + 1
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		s.w = nil
+		return err
+	}
+	s.w, s.wSize = f, 0
+	s.segs = append(s.segs, seq)
+	return nil
+}
+
+func (s *Spool) Depth() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.depth
+}
+
+func (s *Spool) Stat() SpoolStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SpoolStat{
+		Depth:          s.depth,
+		Bytes:          s.bytes,
+		NumSpooled:     s.numSpooled,
+		NumReplayed:    s.numReplayed,
+		NumSkipped:     s.numSkipped,
+		NumDropped:     s.numDropped,
+		Backoff:        s.backoff.String(),
+		LastError:      s.lastError,
+		LastReplayTime: s.lastReplay,
+	}
+}
+
+// replay the records in order with save, backing off while save fails with
+// a retryable error. records failing otherwise are skipped
+func (s *Spool) Replay(save func(*Position) error, retryable func(error) bool) {
+	defer close(s.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		case <-s.notify:
+			// a new record, replay it right away unless backing off
+			s.lock.Lock()
+			backingOff := s.lastError != ""
+			s.lock.Unlock()
+			if backingOff {
+				continue
+			}
+		}
+
+		err := s.replay(save, retryable)
+		s.lock.Lock()
+		if err != nil {
+			s.lastError = err.Error()
+			s.backoff *= 2
+			if s.backoff > SPOOL_MAX_BACKOFF {
+				s.backoff = SPOOL_MAX_BACKOFF
+			}
+			log.Warn("spool: replay stopped, ", err, ", retry in ", s.backoff)
+		} else {
+			s.lastError = ""
+			s.backoff = SPOOL_MIN_BACKOFF
+		}
+		timer.Reset(s.backoff)
+		s.lock.Unlock()
+	}
+}
+
+// replay until the spool is empty or a retryable error
+func (s *Spool) replay(save func(*Position) error, retryable func(error) bool) error {
+	for {
+		s.lock.Lock()
+		if len(s.segs) == 0 || s.depth == 0 {
+			s.lock.Unlock()
+			return nil
+		}
+		seq, off := s.segs[0], s.rOff
+		s.lock.Unlock()
+
+		more, err := s.replaySegment(seq, off, save, retryable)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// replay a segment from off, more is true if the segment has been read up
+// and removed, so the next one is to be replayed
+func (s *Spool) replaySegment(seq uint64, off int64, save func(*Position) error,
+	retryable func(error) bool) (more bool, err error) {
+	f, err := os.Open(s.path(seq))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	num := 0
+	r := bufio.NewReader(f)
+	defer func() {
+		s.lock.Lock()
+		s.saveOffset()
+		s.lock.Unlock()
+	}()
+	for {
+		select {
+		case <-s.stop:
+			return false, nil
+		default:
+		}
+
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// a partial line is being written
+			break
+		}
+		p := &Position{}
+		if err := json.Unmarshal(line, p); err != nil {
+			log.Error("spool: invalid record: ", string(line))
+			s.consume(int64(len(line)), false)
+			num++
+			continue
+		}
+		if err := save(p); err != nil {
+			if retryable(err) {
+				return false, err
+			}
+			log.Error("spool: record skipped: ", string(line), ", ", err)
+			s.consume(int64(len(line)), false)
+		} else {
+			s.consume(int64(len(line)), true)
+		}
+		num++
+		if num%SPOOL_SYNC_RECORDS == 0 {
+			s.lock.Lock()
+			s.saveOffset()
+			s.lock.Unlock()
+		}
+	}
+
+	// end of the segment, remove it unless it's still being written
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.segs) == 0 || s.segs[0] != seq {
+		return false, nil
+	}
+	if len(s.segs) > 1 || s.w == nil {
+		os.Remove(s.path(seq))
+		s.segs = s.segs[1:]
+		s.rOff = 0
+		return true, nil
+	}
+	if s.depth == 0 {
+		// read up, start over
+		s.w.Close()
+		s.w = nil
+		os.Remove(s.path(seq))
+		s.segs = s.segs[:0]
+		s.rOff, s.bytes = 0, 0
+	}
+	return false, nil
+}
+
+func (s *Spool) consume(n int64, replayed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rOff += n
+	s.bytes -= n
+	s.depth--
+	if replayed {
+		s.numReplayed++
+		s.lastReplay = time.Now()
+	} else {
+		s.numSkipped++
+	}
+}
+
+// stop the replay, waiting for the record being saved until the deadline,
+// the records left are replayed on the next run
+func (s *Spool) Close(deadline time.Time) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-time.After(deadline.Sub(time.Now())):
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w != nil {
+		s.w.Sync()
+		s.w.Close()
+		s.w = nil
+	}
+	s.saveOffset()
+	if s.depth > 0 {
+		log.Warn("spool: ", s.depth, " records left in ", s.dir)
+	}
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("connection refused")
+var errBad = errors.New("bad record")
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Put(&Position{Imei: strconv.Itoa(i), Ts: int64(i)})
+	}
+	if s.Depth() != 10 {
+		t.Fatal("depth:", s.Depth())
+	}
+	s.Close(time.Now())
+
+	// records are kept across runs
+	s, err = NewSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Depth() != 10 {
+		t.Fatal("depth after reopen:", s.Depth())
+	}
+
+	var lock sync.Mutex
+	down := true
+	got := make([]int64, 0)
+	save := func(p *Position) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if down {
+			return errDown
+		}
+		if p.Ts == 3 {
+			return errBad
+		}
+		got = append(got, p.Ts)
+		return nil
+	}
+	retryable := func(err error) bool { return err == errDown }
+
+	go s.Replay(save, retryable)
+	time.Sleep(50 * time.Millisecond)
+	if s.Stat().LastError == "" || s.Depth() != 10 {
+		t.Fatal("expected backoff:", s.Stat())
+	}
+
+	lock.Lock()
+	down = false
+	lock.Unlock()
+	for i := 0; i < 30 && s.Depth() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	stat := s.Stat()
+	if stat.Depth != 0 || stat.Bytes != 0 || stat.NumReplayed != 9 || stat.NumSkipped != 1 {
+		t.Fatal("unexpected stat:", stat)
+	}
+	for i, v := range []int64{0, 1, 2, 4, 5, 6, 7, 8, 9} {
+		if got[i] != v {
+			t.Fatal("out of order:", got)
+		}
+	}
+	s.Close(time.Now().Add(time.Second))
+}
+
+func TestSpoolCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for i := 0; i < 10; i++ {
+		if s.Put(&Position{Imei: "123456789012345", Ts: int64(i)}) {
+			n++
+		}
+	}
+	if n == 0 || n == 10 || s.Stat().NumDropped != uint64(10-n) || s.Stat().Bytes > 100 {
+		t.Fatal("unexpected stat:", n, s.Stat())
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"github.com/mattn/go-sqlite3"
+)
+
+// file:/var/lib/lbsas/lbsas.db?_busy_timeout=5000&_journal_mode=WAL
+// sqlite has a single writer, the busy timeout makes the writers wait for
+// each other instead of failing
+func init() {
+	registerDialect(&dialect{name: "sqlite3", autoId: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		classify: sqliteClassify})
+}
+
+func sqliteClassify(err error) (known, retry bool) {
+	e, ok := err.(sqlite3.Error)
+	if !ok {
+		return false, false
+	}
+	switch e.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrIoErr, sqlite3.ErrFull, sqlite3.ErrCantOpen:
+		return true, true
+	}
+	return true, false
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_DB_DRIVER = "mysql"
+	STORAGE_SQL       = "sql"
+	STORAGE_MONGO     = "mongo"
+)
+
+// where the decoded positions end up, the vendors only produce Position
+// records, the backend decides how they're stored
+type Storage interface {
+	Name() string
+	// store an event per position and update the latest data of their
+	// devices, ids[i] is the device id of rows[i]. replayed positions may
+	// be older than the latest data, they don't overwrite it
+	SavePositions(ids []string, rows []*Position, replay bool) error
+	// errors that may go away once the storage is reachable again
+	Retryable(err error) bool
+	Close() error
+}
+
+// sql flavour of a database/sql driver
+type dialect struct {
+	name string
+	// $1, $2... instead of ?
+	numbered bool
+	// type of an auto increment primary key
+	autoId string
+	// known tells if the error comes from the driver, retry if it's
+	// worth retrying
+	classify func(err error) (known, retry bool)
+}
+
+var _Dialects = make(map[string]*dialect)
+
+// the dialect of _DB, mysql unless set by New()
+var _Dialect *dialect = nil
+
+// storage of the positions, the sql database of _DB unless set by New()
+var _Storage Storage = nil
+
+func registerDialect(d *dialect) {
+	_Dialects[d.name] = d
+}
+
+func getDialect(driver string) (*dialect, error) {
+	if driver == "" {
+		driver = DEFAULT_DB_DRIVER
+	}
+	d, ok := _Dialects[driver]
+	if !ok {
+		names := make([]string, 0, len(_Dialects))
+		for k := range _Dialects {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unsupported db driver %q, one of %s", driver, strings.Join(names, "|"))
+	}
+	return d, nil
+}
+
+// rewrite the ? placeholders of a query for the dialect
+func (d *dialect) rebind(q string) string {
+	if d == nil || !d.numbered {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(q); i++ {
+		if q[i] == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(q[i])
+	}
+	return b.String()
+}
+
+// queries on _DB are written with ? placeholders
+func rebind(q string) string {
+	return _Dialect.rebind(q)
+}
+
+// insert a row of an autoId id, returns the id. postgres has no
+// LastInsertId
+func (d *dialect) insertId(tx *sql.Tx, q string, args ...interface{}) (int64, error) {
+	var id int64
+	if d.name == "postgres" {
+		err := tx.QueryRow(d.rebind(q)+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	ret, err := tx.Exec(d.rebind(q), args...)
+	if err != nil {
+		return 0, err
+	}
+	return ret.LastInsertId()
+}
+
+// *sql.DB or *sql.Tx, rebinding the queries for the dialect
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type rebinder struct {
+	execer
+	d *dialect
+}
+
+func (r rebinder) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.execer.Exec(r.d.rebind(query), args...)
+}
+
+// positions stored into eventdata and devicelatestdata of a sql database
+type sqlStorage struct {
+	db *sql.DB
+	d  *dialect
+}
+
+func newSQLStorage(db *sql.DB, d *dialect) *sqlStorage {
+	return &sqlStorage{db: db, d: d}
+}
+
+func (s *sqlStorage) Name() string {
+	return s.d.name
+}
+
+// one multi-row insert of the events and one update of the latest data per
+// device, in a transaction
+func (s *sqlStorage) SavePositions(ids []string, rows []*Position, replay bool) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	ex := rebinder{tx, s.d}
+	if err := insertEvents(ex, ids, rows); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for id, p := range latestOf(ids, rows) {
+		if err := updateLatest(ex, id, p, replay || p.Backfill); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStorage) Retryable(err error) bool {
+	if known, retry := s.d.classify(err); known {
+		return retry
+	}
+	return true
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+// the latest position of each device, the events without gps data only
+// if the device has no other position
+func latestOf(ids []string, rows []*Position) map[string]*Position {
+	latest := make(map[string]*Position)
+	for i, p := range rows {
+		old, ok := latest[ids[i]]
+		if !ok || (old.NoGPS && !p.NoGPS) || (old.NoGPS == p.NoGPS && p.Ts >= old.Ts) {
+			latest[ids[i]] = p
+		}
+	}
+	return latest
+}
+
+// empty for null
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// one multi-row insert into eventdata
+func insertEvents(ex execer, ids []string, rows []*Position) error {
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*12)
+	for i, p := range rows {
+		values[i] = "(?,?,?,?,?,?,?,?,?,?,?,?)"
+		if p.NoGPS {
+			args = append(args, ids[i], p.Ts, nil, nil, nil, nil)
+		} else {
+			args = append(args, ids[i], p.Ts, p.Lat, p.Lon, p.Speed, p.Heading)
+		}
+		backfill := 0
+		if p.Backfill {
+			backfill = 1
+		}
+		args = append(args, nullable(p.Event), nullable(p.Data), backfill, nullable(p.Flags),
+			nullable(p.Battery), nullable(p.Voltage))
+	}
+	_, err := ex.Exec(`INSERT INTO eventdata(deviceId, timestamp, latitude, longitude, speed, heading,
+	     eventType, eventData, backfill, flags, batteryLevel, batteryVoltage) VALUES `+strings.Join(values, ","), args...)
+	return err
+}
+
+// update devicelatestdata, a position without location only updates the
+// rest, an event without gps data only the ack time. the battery is kept
+// unless reported. replayed and backfilled positions may be older than the
+// latest data, they don't overwrite it
+func updateLatest(ex execer, id string, p *Position, replay bool) error {
+	cond := " and (gpsTimestamp is null or gpsTimestamp<?)"
+	var set string
+	var args []interface{}
+	if p.NoGPS {
+		// the device is alive, that's all
+		cond = " and (lastAckTime is null or lastAckTime<?)"
+		set, args = "lastAckTime=?, updateTime=?", []interface{}{p.Ts, p.Ts}
+	} else if p.Lat == "0" && p.Lon == "0" {
+		set = "lastAckTime=?, speed=?, heading=?, gpsTimestamp=?, updateTime=?"
+		args = []interface{}{p.Ts, p.Speed, p.Heading, p.Ts, p.Ts}
+	} else {
+		set = "lastAckTime=?, latitude=?, longitude=?, speed=?, heading=?, gpsTimestamp=?, updateTime=?"
+		args = []interface{}{p.Ts, p.Lat, p.Lon, p.Speed, p.Heading, p.Ts, p.Ts}
+	}
+	set += ", batteryLevel=COALESCE(?, batteryLevel), batteryVoltage=COALESCE(?, batteryVoltage)"
+	args = append(args, nullable(p.Battery), nullable(p.Voltage), id)
+	if replay {
+		args = append(args, p.Ts)
+	} else {
+		cond = ""
+	}
+	_, err := ex.Exec("UPDATE devicelatestdata SET "+set+" where deviceId=?"+cond, args...)
+	return err
+}
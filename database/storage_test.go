@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	d := &dialect{numbered: true}
+	if q := d.rebind("update t set a=? where b=? and c=?"); q != "update t set a=$1 where b=$2 and c=$3" {
+		t.Fatal("unexpected query:", q)
+	}
+	if q := (&dialect{}).rebind("a=?"); q != "a=?" {
+		t.Fatal("unexpected query:", q)
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := getDialect("sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "test.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSQLStorage(db, d)
+	defer s.Close()
+	for _, q := range []string{
+		`create table eventdata(deviceId text, timestamp integer, latitude text,
+		longitude text, speed text, heading text, eventType text, eventData text, backfill integer, flags text,
+		batteryLevel integer, batteryVoltage text)`,
+		`create table devicelatestdata(deviceId text, lastAckTime integer, latitude text,
+		longitude text, speed text, heading text, gpsTimestamp integer, updateTime integer,
+		batteryLevel integer, batteryVoltage text)`,
+		`insert into devicelatestdata(deviceId) values ('1'), ('2')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := []*Position{
+		{Lat: "30.1", Lon: "120.1", Speed: "1", Heading: "90", Ts: 10},
+		{Lat: "30.2", Lon: "120.2", Speed: "2", Heading: "90", Ts: 20, Battery: "80"},
+		{Lat: "31.1", Lon: "121.1", Speed: "3", Heading: "90", Ts: 15},
+		// newer, but without gps data
+		{Ts: 30, Event: "GTPNA", Data: "type=4", NoGPS: true},
+	}
+	if err := s.SavePositions([]string{"1", "1", "2", "1"}, rows, false); err != nil {
+		t.Fatal(err)
+	}
+	// older than the latest data, only the event is stored
+	if err := s.SavePositions([]string{"1"}, []*Position{{Lat: "29", Lon: "119", Ts: 5}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow("select count(*) from eventdata").Scan(&n); err != nil || n != 5 {
+		t.Fatal("unexpected events:", n, err)
+	}
+	if err := db.QueryRow("select count(*) from eventdata where eventType='GTPNA' and latitude is null").Scan(&n); err != nil || n != 1 {
+		t.Fatal("unexpected power on events:", n, err)
+	}
+	// buffered by the device, older than the latest data
+	if err := s.SavePositions([]string{"2"}, []*Position{{Lat: "28", Lon: "118", Ts: 12, Backfill: true}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select count(*) from eventdata where backfill=1").Scan(&n); err != nil || n != 1 {
+		t.Fatal("unexpected backfilled events:", n, err)
+	}
+	var lat string
+	var ts int64
+	err = db.QueryRow("select latitude, gpsTimestamp from devicelatestdata where deviceId='2'").Scan(&lat, &ts)
+	if err != nil || lat != "31.1" || ts != 15 {
+		t.Fatal("unexpected latest data:", lat, ts, err)
+	}
+	var battery int
+	err = db.QueryRow("select latitude, gpsTimestamp, batteryLevel from devicelatestdata where deviceId='1'").Scan(&lat, &ts, &battery)
+	if err != nil || lat != "30.2" || ts != 20 || battery != 80 {
+		t.Fatal("unexpected latest data:", lat, ts, battery, err)
+	}
+
+	if _, err := db.Exec("drop table eventdata"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePositions([]string{"2"}, rows[:1], false); err == nil || s.Retryable(err) {
+		t.Fatal("expected a permanent error:", err)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// policies for the packets of the imeis missing from the device table
+const (
+	// log and drop the packets
+	UNKNOWN_DROP = "drop"
+	// close the connection
+	UNKNOWN_REJECT = "reject"
+	// register the device in pending_devices for approval, its packets are
+	// dropped until approved, only their count is kept
+	UNKNOWN_PENDING = "pending"
+	// insert the device with the default owner
+	UNKNOWN_PROVISION = "provision"
+)
+
+const (
+	// pending_devices is updated once per interval per device at most
+	PENDING_INTERVAL = time.Minute
+	// the unknown devices silent for this long are forgotten
+	UNKNOWN_FORGET = 10 * PENDING_INTERVAL
+)
+
+var (
+	ErrDeviceRejected = errors.New("unknown device rejected")
+	ErrDevicePending  = errors.New("unknown device pending approval")
+)
+
+var _UnknownPolicy = UNKNOWN_DROP
+var _DefaultOwner = 0
+var _Unknowns = &unknownDevices{m: make(map[string]*unknownDevice)}
+
+func ValidUnknownPolicy(policy string) bool {
+	switch policy {
+	case UNKNOWN_DROP, UNKNOWN_REJECT, UNKNOWN_PENDING, UNKNOWN_PROVISION:
+		return true
+	}
+	return false
+}
+
+// a device waiting for approval
+type PendingDevice struct {
+	Imei       string `json:"imei"`
+	Vendor     string `json:"vendor"`
+	RemoteAddr string `json:"remoteAddr"`
+	FirstSeen  int64  `json:"firstSeen"`
+	LastSeen   int64  `json:"lastSeen"`
+	NumPackets int64  `json:"numPackets"`
+}
+
+// packets of an unknown device since the last update of pending_devices
+type unknownDevice struct {
+	vendor, remote string
+	num            int64
+	lastSeen       time.Time
+	lastWrite      time.Time
+}
+
+type unknownDevices struct {
+	lock      sync.Mutex
+	m         map[string]*unknownDevice
+	lastSweep time.Time
+}
+
+// count a packet of the device, returns the packets to be written to
+// pending_devices, 0 until the interval has elapsed since the last write
+func (u *unknownDevices) add(imei, vendor, remote string) int64 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	now := time.Now()
+	if now.Sub(u.lastSweep) > UNKNOWN_FORGET {
+		u.lastSweep = now
+		for k, v := range u.m {
+			if now.Sub(v.lastSeen) > UNKNOWN_FORGET {
+				delete(u.m, k)
+			}
+		}
+	}
+
+	d, ok := u.m[imei]
+	if !ok {
+		d = &unknownDevice{}
+		u.m[imei] = d
+	}
+	d.num++
+	d.lastSeen = now
+	if vendor != "" {
+		d.vendor = vendor
+	}
+	if remote != "" {
+		d.remote = remote
+	}
+	if now.Sub(d.lastWrite) < PENDING_INTERVAL {
+		return 0
+	}
+	n := d.num
+	d.num, d.lastWrite = 0, now
+	return n
+}
+
+func (u *unknownDevices) get(imei string) (vendor, remote string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if d, ok := u.m[imei]; ok {
+		return d.vendor, d.remote
+	}
+	return "", ""
+}
+
+func (u *unknownDevices) forget(imei string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.m, imei)
+}
+
+// device id of the imei, the unknown devices are handled by the policy:
+// sql.ErrNoRows if dropped, ErrDeviceRejected once conn is closed,
+// ErrDevicePending, or the id of the provisioned device.
+// vendor and conn are optional, the vendor is recorded on the device
+func LookupDevice(imei, vendor string, conn net.Conn) (string, error) {
+	id, err := GetIdByImei(imei)
+	if err != sql.ErrNoRows {
+		if err == nil {
+			_Vendors.record(id, vendor)
+		}
+		return id, err
+	}
+
+	remote := ""
+	if conn != nil {
+		remote = conn.RemoteAddr().String()
+	}
+	switch _UnknownPolicy {
+	case UNKNOWN_REJECT:
+		if _Unknowns.add(imei, vendor, remote) > 0 {
+			log.Warn("unknown device rejected: ", imei, ", vendor: ", vendor, ", from: ", remote)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return "", ErrDeviceRejected
+	case UNKNOWN_PENDING:
+		if n := _Unknowns.add(imei, vendor, remote); n > 0 {
+			vendor, remote = _Unknowns.get(imei)
+			if err := addPending(imei, vendor, remote, n); err != nil {
+				log.Error("can't add pending device ", imei, ": ", err)
+			}
+		}
+		return "", ErrDevicePending
+	case UNKNOWN_PROVISION:
+		id, err := ProvisionDevice(imei, vendor, _DefaultOwner)
+		if err != nil {
+			log.Error("can't provision ", imei, ": ", err)
+			return "", err
+		}
+		log.Warn("device provisioned: ", imei, ", id: ", id, ", vendor: ", vendor, ", from: ", remote)
+		return id, nil
+	}
+	return id, err
+}
+
+// count n dropped packets of the device in pending_devices
+func addPending(imei, vendor, remote string, n int64) error {
+	now := time.Now().UnixNano() / 1000000
+	ret, err := _DB.Exec(rebind(`UPDATE pending_devices SET vendor=?, remoteAddr=?, lastSeen=?,
+	numPackets=numPackets+? where imei=?`), vendor, remote, now, n, imei)
+	if err != nil {
+		return err
+	}
+	if num, err := ret.RowsAffected(); err == nil && num > 0 {
+		return nil
+	}
+	log.Warn("unknown device pending approval: ", imei, ", vendor: ", vendor, ", from: ", remote)
+	_, err = _DB.Exec(rebind(`INSERT INTO pending_devices(imei, vendor, remoteAddr,
+	firstSeen, lastSeen, numPackets) VALUES (?,?,?,?,?,?)`), imei, vendor, remote, now, now, n)
+	return err
+}
+
+// insert the device and its latest data, owner 0 for none, vendor empty if
+// unknown. the id of an existing device is returned
+func ProvisionDevice(imei, vendor string, owner int) (string, error) {
+	var ownerId interface{} = nil
+	if owner > 0 {
+		ownerId = owner
+	}
+
+	tx, err := _DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	var id string
+	_, err = tx.Exec(rebind("INSERT INTO device(deviceImei, ownerId, vendor) VALUES (?,?,?)"), imei, ownerId,
+		nullable(vendor))
+	if err == nil {
+		err = tx.QueryRow(rebind("select id from device where deviceImei=?"), imei).Scan(&id)
+	}
+	if err == nil {
+		_, err = tx.Exec(rebind("INSERT INTO devicelatestdata(deviceId) VALUES (?)"), id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	_Identities.invalidate(imei)
+	_Unknowns.forget(imei)
+	if err != nil {
+		// provisioned by another worker meanwhile
+		if id, e := GetIdByImei(imei); e == nil {
+			return id, nil
+		}
+		return "", err
+	}
+	_Identities.put(id, imei)
+	return id, nil
+}
+
+// the devices waiting for approval, the latest seen first
+func GetPendingDevices() ([]*PendingDevice, error) {
+	rows, err := _DB.Query(`select imei, vendor, remoteAddr, firstSeen, lastSeen, numPackets
+	from pending_devices order by lastSeen desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]*PendingDevice, 0)
+	for rows.Next() {
+		d := &PendingDevice{}
+		var vendor, remote sql.NullString
+		if err := rows.Scan(&d.Imei, &vendor, &remote, &d.FirstSeen, &d.LastSeen, &d.NumPackets); err != nil {
+			return nil, err
+		}
+		d.Vendor, d.RemoteAddr = vendor.String, remote.String
+		ret = append(ret, d)
+	}
+	return ret, rows.Err()
+}
+
+// provision a pending device, owner 0 for the default one. the packets
+// dropped while pending are lost, the device reports from now on
+func ApproveDevice(imei string, owner int) (string, error) {
+	if owner <= 0 {
+		owner = _DefaultOwner
+	}
+	var vendor sql.NullString
+	err := _DB.QueryRow(rebind("select vendor from pending_devices where imei=?"), imei).Scan(&vendor)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	id, err := ProvisionDevice(imei, vendor.String, owner)
+	if err != nil {
+		return "", err
+	}
+	if err := DiscardPendingDevice(imei); err != nil {
+		log.Error("approved device still pending: ", imei, ", ", err)
+	}
+	log.Warn("device approved: ", imei, ", id: ", id)
+	return id, nil
+}
+
+// drop a pending device, it's pending again if it keeps reporting
+func DiscardPendingDevice(imei string) error {
+	_, err := _DB.Exec(rebind("DELETE FROM pending_devices where imei=?"), imei)
+	_Unknowns.forget(imei)
+	return err
+}
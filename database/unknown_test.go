@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a migrated sqlite database as _DB, restored by the returned func
+func testDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := getDialect("sqlite3")
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "test.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := migrate(db, d, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDB, oldDialect, oldIds := _DB, _Dialect, _Identities
+	_DB, _Dialect, _Identities = db, d, newIdentityCache(time.Hour, time.Hour)
+	return func() {
+		_DB, _Dialect, _Identities = oldDB, oldDialect, oldIds
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnknownRateLimit(t *testing.T) {
+	u := &unknownDevices{m: make(map[string]*unknownDevice)}
+	if n := u.add("1", "eworld", "a"); n != 1 {
+		t.Fatal("expected the first packet written:", n)
+	}
+	for i := 0; i < 5; i++ {
+		if n := u.add("1", "", ""); n != 0 {
+			t.Fatal("expected rate limited:", n)
+		}
+	}
+	u.m["1"].lastWrite = time.Now().Add(-PENDING_INTERVAL)
+	if n := u.add("1", "", "b"); n != 6 {
+		t.Fatal("expected the packets counted:", n)
+	}
+	if vendor, remote := u.get("1"); vendor != "eworld" || remote != "b" {
+		t.Fatal("unexpected device:", vendor, remote)
+	}
+}
+
+func TestUnknownPolicies(t *testing.T) {
+	defer testDB(t)()
+	defer func(p string) { _UnknownPolicy = p }(_UnknownPolicy)
+
+	_UnknownPolicy = UNKNOWN_DROP
+	if _, err := LookupDevice("111", "eworld", nil); err != sql.ErrNoRows {
+		t.Fatal("expected dropped:", err)
+	}
+
+	_UnknownPolicy = UNKNOWN_PENDING
+	if _, err := LookupDevice("222", "eworld", nil); err != ErrDevicePending || Retryable(err) {
+		t.Fatal("expected pending:", err)
+	}
+	LookupDevice("222", "eworld", nil)
+	pending, err := GetPendingDevices()
+	if err != nil || len(pending) != 1 || pending[0].Imei != "222" || pending[0].Vendor != "eworld" {
+		t.Fatal("unexpected pending devices:", pending, err)
+	}
+	id, err := ApproveDevice("222", 7)
+	if err != nil || id == "" {
+		t.Fatal("can't approve:", err)
+	}
+	if got, err := LookupDevice("222", "eworld", nil); err != nil || got != id {
+		t.Fatal("expected the approved device:", got, err)
+	}
+	if pending, _ := GetPendingDevices(); len(pending) != 0 {
+		t.Fatal("expected no pending device:", pending)
+	}
+	var owner int
+	if err := _DB.QueryRow("select ownerId from device where id=?", id).Scan(&owner); err != nil || owner != 7 {
+		t.Fatal("unexpected owner:", owner, err)
+	}
+
+	_UnknownPolicy = UNKNOWN_PROVISION
+	id, err = LookupDevice("333", "eworld", nil)
+	if err != nil || id == "" {
+		t.Fatal("can't provision:", err)
+	}
+	var n int
+	if err := _DB.QueryRow("select count(*) from devicelatestdata where deviceId=?", id).Scan(&n); err != nil || n != 1 {
+		t.Fatal("expected the latest data row:", n, err)
+	}
+	if again, err := ProvisionDevice("333", "", 0); err != nil || again != id {
+		t.Fatal("expected the existing device:", again, err)
+	}
+	if vendor, err := GetDeviceVendor(id); err != nil || vendor != "eworld" {
+		t.Fatal("unexpected vendor:", vendor, err)
+	}
+	// reporting by another protocol
+	LookupDevice("333", "gl500", nil)
+	if vendor, err := GetDeviceVendor(id); err != nil || vendor != "gl500" {
+		t.Fatal("unexpected vendor:", vendor, err)
+	}
+}
@@ -7,6 +7,7 @@
 package datatypes
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"runtime"
@@ -34,20 +35,78 @@ type RawTcpPacket struct {
 // command line args
 type EnviromentCfg struct {
 	DBMaxOpenConns, DBMaxIdleConns,
-	QueueSizePerConn, NumWorkersPerConn, TCPTimeOutSec, NumUDPWokers int
+	QueueSizePerConn, NumWorkersPerConn, TCPTimeOutSec, NumUDPWokers,
+	ShutdownTimeoutSec int
 	LogLevel                          log.Level
 	TCPAddr, HTTPAddr, DBAddr, LbsUrl string
 	DBCacheSize, MsgCacheSize         int64
 
+	// database/sql driver of DBAddr: mysql, postgres or sqlite3
+	DBDriver string
+	// storage of the positions: sql, the database of DBAddr, or mongo
+	Storage, MongoAddr string
+	// cache ttl of the imei <-> device id pairs, and of the unknown ones
+	IdentityTTLSec, IdentityNegTTLSec int
+	// policy for the imeis missing from the device table: drop, reject,
+	// pending or provision with DefaultOwner, 0 for none
+	UnknownPolicy string
+	DefaultOwner  int
+	// a sent command is unconfirmed without ack in this duration
+	CmdAckTimeoutSec int
+	// a battery below the percentage, or the voltage if the device reports
+	// no percentage, raises an event. 0 for the default, negative to disable
+	LowBatteryPct, LowBatteryVolt float64
+	// ip:port the devices reach this server by, a SRVADDR moving the
+	// devices to one of them is done once they've reconnected
+	PublicAddrs []string
+
 	DType string
+
+	// listener table, one server is started per entry
+	Listeners []ListenerCfg
+
+	// default certificate of the tls listeners, and of the http api
+	TLSCertFile, TLSKeyFile, HTTPCertFile, HTTPKeyFile, HTTPClientCAFile string
+	// tls of the listener being started, nil for plain tcp
+	TLSConfig *tls.Config
+
+	// overload policy of the packet queues of the listener being started
+	// and of the database queue, see pool.ParsePolicy
+	QueuePolicy, DBQueuePolicy string
+	// spill files of the packet queues, and the disk cap per listener
+	SpillDir   string
+	SpillMaxMB int64
+	// spool of the positions that can't be stored for now, disabled if empty
+	SpoolDir   string
+	SpoolMaxMB int64
+
+	// db writers, each stores the positions by batches of DBBatchSize
+	// or every DBBatchIntervalMs
+	DBWriters, DBBatchSize, DBBatchIntervalMs int
+}
+
+// one entry of the listener table, e.g: eworld,tcp,0.0.0.0:9020
+// or with its own certificate: atr805,tls,0.0.0.0:9443,cert.pem,key.pem
+// and options: eworld,tcp,0.0.0.0:9020,policy=block:500ms
+type ListenerCfg struct {
+	Vendor, Protocol, Addr string
+	CertFile, KeyFile      string
+	// queue overload policy, the default one if empty
+	Policy string
+}
+
+func (l ListenerCfg) Name() string {
+	return l.Vendor + "@" + l.Addr
 }
 
 // vendor
 type Vendor interface {
 	GetCfg() *NetConfig
 	SetLogLevel(log.Level)
+	GetStat() *VendorStat
 	Close()
-	TcpWorker(packetsChan chan *RawTcpPacket)
+	HandlePacket(packet *RawTcpPacket) bool
+	DeviceKey(buff []byte) string
 	IsWholePacket(buff []byte, status *int) (bool, error)
 }
 
@@ -60,11 +119,14 @@ type VendorStat struct {
 // tcp configurations
 type NetConfig struct {
 	// config
-	Addr, Protocol, HttpAddr, DBAddr  string
-	StartSymbol, EndSymbol            byte
-	ChanSize, PacketMaxLen, WorkerNum int
-	ReadTimeoutSec                    time.Duration
-	LogLevel                          log.Level
+	Vendor, Addr, Protocol, HttpAddr, DBAddr string
+	StartSymbol, EndSymbol                   byte
+	ChanSize, PacketMaxLen, WorkerNum        int
+	ReadTimeoutSec                           time.Duration
+	LogLevel                                 log.Level
+	TLSConfig                                *tls.Config
+	QueuePolicy, SpillDir                    string
+	SpillMaxMB                               int64
 }
 
 // framework statistics
@@ -80,7 +142,7 @@ type NetStatus struct {
 	StartTime, LastTime, NowTime time.Time
 
 	//
-	MemStat runtime.MemStats
+	MemStat runtime.MemStats `json:"-"`
 }
 
 type WSGLocation struct {
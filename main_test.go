@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseListeners(t *testing.T) {
+	ls, err := ParseListeners("eworld,tcp,0.0.0.0:9020; ty905,udp,0.0.0.0:9022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 || ls[1].Vendor != "ty905" || ls[1].Addr != "0.0.0.0:9022" {
+		t.Error("unexpected listeners", ls)
+	}
+	if ls[0].Name() != "eworld@0.0.0.0:9020" {
+		t.Error("expected", "eworld@0.0.0.0:9020", "got", ls[0].Name())
+	}
+
+	ls, err = ParseListeners("atr805,tls,:9443,cert.pem,key.pem")
+	if err != nil || ls[0].CertFile != "cert.pem" || ls[0].KeyFile != "key.pem" {
+		t.Error("unexpected tls listener", ls, err)
+	}
+
+	ls, err = ParseListeners("eworld,tcp,:1,policy=block:2s;atr805,tls,:2,cert.pem,key.pem,policy=spill")
+	if err != nil || ls[0].Policy != "block:2s" || ls[1].Policy != "spill" || ls[1].KeyFile != "key.pem" {
+		t.Error("unexpected policy", ls, err)
+	}
+
+	for _, v := range []string{"", "eworld,udp,0.0.0.0:9020", "foo,tcp,:1",
+		"eworld,tcp,:1;gl500,tcp,:1", "ty905,tls,:1", "eworld,tcp,:1,cert.pem,key.pem",
+		"eworld,tls,:1;gl500,tcp,:1", "eworld,tcp,:1,policy=foo", "eworld,tcp,:1,queue=1"} {
+		if _, err := ParseListeners(v); err == nil {
+			t.Error("expected error for", v)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package pool
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what to do when a queue is full
+type Policy int
+
+const (
+	// drop the oldest queued item to make room for the new one
+	DropOldest Policy = iota
+	// drop the new item
+	DropNewest
+	// wait for room up to BlockTimeout, then drop the new item
+	Block
+	// append the new item to a file, they go back to the queue in order
+	// once there is room
+	Spill
+)
+
+const (
+	DEFAULT_BLOCK_TIMEOUT = time.Second
+	// num of devices with the most drops reported in the statistics
+	TOP_DROPS = 20
+	// devices beyond this are counted under DROPS_OTHERS
+	MAX_DROPS_DEVICES = 10000
+	DROPS_OTHERS      = "others"
+)
+
+var _PolicyNames = map[Policy]string{
+	DropOldest: "drop-oldest",
+	DropNewest: "drop-newest",
+	Block:      "block",
+	Spill:      "spill",
+}
+
+func (p Policy) String() string {
+	return _PolicyNames[p]
+}
+
+// serialize items to be spilled to disk
+type Codec interface {
+	Encode(item interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// overload handling of a pool, the zero value is drop-oldest
+type Options struct {
+	Policy       Policy
+	BlockTimeout time.Duration
+
+	// Spill only: directory of the spill files, disk usage cap of the pool
+	// in bytes (0 for no cap) and the item serializer
+	SpillDir      string
+	SpillMaxBytes int64
+	Codec         Codec
+}
+
+func (o Options) String() string {
+	if o.Policy == Block {
+		return o.Policy.String() + ":" + o.BlockTimeout.String()
+	}
+	return o.Policy.String()
+}
+
+// parse a policy: drop-oldest, drop-newest, block[:timeout] or spill,
+// e.g: block:500ms
+func ParsePolicy(s string) (Options, error) {
+	ret := Options{}
+	name, arg := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	for k, v := range _PolicyNames {
+		if v == name {
+			ret.Policy = k
+			if k == Block {
+				ret.BlockTimeout = DEFAULT_BLOCK_TIMEOUT
+				if arg != "" {
+					d, err := time.ParseDuration(arg)
+					if err != nil || d <= 0 {
+						return ret, errors.New("invalid block timeout: " + s)
+					}
+					ret.BlockTimeout = d
+				}
+			} else if arg != "" {
+				return ret, errors.New("unexpected policy argument: " + s)
+			}
+			return ret, nil
+		}
+	}
+	return ret, errors.New("unknown queue policy: " + s)
+}
+
+// options of a packet pool: the policy, default drop-oldest if empty, and
+// the spill files under dir up to maxMB megabytes (0 for no cap)
+func ParseOptions(policy, dir string, maxMB int64, codec Codec) (Options, error) {
+	if policy == "" {
+		return Options{}, nil
+	}
+	ret, err := ParsePolicy(policy)
+	if err != nil {
+		return ret, err
+	}
+	if ret.Policy == Spill {
+		ret.SpillDir = dir
+		ret.SpillMaxBytes = maxMB << 20
+		ret.Codec = codec
+	}
+	return ret, nil
+}
+
+// num of dropped items per device
+type Drops struct {
+	lock sync.Mutex
+	keys map[string]uint64
+}
+
+func (d *Drops) Add(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.keys == nil {
+		d.keys = make(map[string]uint64)
+	}
+	if _, ok := d.keys[key]; !ok && len(d.keys) >= MAX_DROPS_DEVICES {
+		key = DROPS_OTHERS
+	}
+	d.keys[key]++
+}
+
+// num of drops of a device
+func (d *Drops) Get(key string) uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.keys[key]
+}
+
+// the n devices with the most drops
+func (d *Drops) Top(n int) map[string]uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	keys := make([]string, 0, len(d.keys))
+	for k := range d.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return d.keys[keys[i]] > d.keys[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	ret := make(map[string]uint64, len(keys))
+	for _, k := range keys {
+		ret[k] = d.keys[k]
+	}
+	return ret
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+// Package pool is a fixed size worker pool shared by all the sessions of
+// a listener. Items are sharded by device identity, the items of one device
+// always go to the same worker so they are handled in order.
+package pool
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type Handler func(item interface{})
+
+// PutWait retries a full queue at this interval
+const PUT_WAIT_RETRY = 10 * time.Millisecond
+
+// an item and the device it belongs to, keep is set by PutWait and the
+// item is never dropped for a newer one
+type entry struct {
+	key  string
+	item interface{}
+	keep bool
+}
+
+// the queue of one worker, spill is nil unless the policy is Spill
+type queue struct {
+	ch    chan entry
+	spill *spillFile
+}
+
+type Pool struct {
+	Name   string
+	Opts   Options
+	queues []*queue
+	handle Handler
+
+	workers   sync.WaitGroup
+	drainers  sync.WaitGroup
+	closing   chan bool
+	stop      chan bool
+	closeLock sync.RWMutex
+	closed    bool
+
+	// bytes on the spill files
+	spillBytes int64
+
+	NumDropped uint64
+	Drops      Drops
+}
+
+// start num workers, each with a queue of size items, overflows are
+// handled according to opts
+func New(name string, num, size int, opts Options, handle Handler) (*Pool, error) {
+	if num < 1 {
+		num = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+	ret := &Pool{Name: name, Opts: opts, queues: make([]*queue, num), handle: handle,
+		closing: make(chan bool), stop: make(chan bool)}
+	for i := 0; i < num; i++ {
+		q := &queue{ch: make(chan entry, size)}
+		if opts.Policy == Spill {
+			var err error
+			if q.spill, err = newSpillFile(ret, q, i); err != nil {
+				for _, v := range ret.queues[:i] {
+					v.spill.remove()
+				}
+				return nil, err
+			}
+		}
+		ret.queues[i] = q
+	}
+	for _, q := range ret.queues {
+		ret.workers.Add(1)
+		go ret.worker(q)
+		if q.spill != nil {
+			ret.drainers.Add(1)
+			go ret.drainer(q)
+		}
+	}
+	log.Info("pool ", name, " started, workers: ", num, ", queue size: ", size, ", policy: ", opts)
+	return ret, nil
+}
+
+func (p *Pool) worker(q *queue) {
+	defer p.workers.Done()
+	for e := range q.ch {
+		p.handle(e.item)
+	}
+}
+
+// index of the worker of the key
+func (p *Pool) shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *Pool) drop(key string) {
+	atomic.AddUint64(&p.NumDropped, 1)
+	p.Drops.Add(key)
+}
+
+// queue an item to the worker of the key, overflows are handled by the
+// policy of the pool. false is returned if any item has been dropped
+func (p *Pool) Put(key string, item interface{}) bool {
+	p.closeLock.RLock()
+	defer p.closeLock.RUnlock()
+	if p.closed {
+		p.drop(key)
+		return false
+	}
+
+	q := p.queues[p.shard(key)]
+	e := entry{key: key, item: item}
+	switch p.Opts.Policy {
+	case DropNewest:
+		select {
+		case q.ch <- e:
+			return true
+		default:
+			p.drop(key)
+			return false
+		}
+	case Block:
+		select {
+		case q.ch <- e:
+			return true
+		default:
+		}
+		timer := time.NewTimer(p.Opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case q.ch <- e:
+			return true
+		case <-timer.C:
+			p.drop(key)
+			return false
+		}
+	case Spill:
+		if q.spill.put(e) {
+			return true
+		}
+		p.drop(key)
+		return false
+	}
+
+	// DropOldest, the entries to keep are queued again ahead of the item,
+	// the item is dropped instead once the queue is full of them
+	ret := true
+	var kept []entry
+	for seen := 0; ; {
+		if len(kept) == 0 && seen >= cap(q.ch) {
+			p.drop(key)
+			return false
+		}
+		next := e
+		if len(kept) > 0 {
+			next = kept[0]
+		}
+		select {
+		case q.ch <- next:
+			if len(kept) == 0 {
+				return ret
+			}
+			kept = kept[1:]
+			continue
+		default:
+		}
+		select {
+		case old := <-q.ch:
+			if old.keep {
+				kept = append(kept, old)
+				seen++
+			} else {
+				p.drop(old.key)
+				ret = false
+			}
+		default:
+		}
+	}
+}
+
+// queue an item that must not be dropped, e.g. the end of a session:
+// waits for room whatever the policy is. false if the pool is closed,
+// also while waiting
+func (p *Pool) PutWait(key string, item interface{}) bool {
+	q := p.queues[p.shard(key)]
+	e := entry{key: key, item: item, keep: true}
+	for {
+		if ok, done := p.tryPut(q, e); done {
+			return ok
+		}
+		// the lock is not held while waiting, Close is never blocked by
+		// a full queue
+		time.Sleep(PUT_WAIT_RETRY)
+	}
+}
+
+// done unless the queue is full
+func (p *Pool) tryPut(q *queue, e entry) (ok, done bool) {
+	p.closeLock.RLock()
+	defer p.closeLock.RUnlock()
+	if p.closed {
+		p.drop(e.key)
+		return false, true
+	}
+	if q.spill != nil && q.spill.put(e) {
+		return true, true
+	}
+	select {
+	case q.ch <- e:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// wait for the group until the deadline, false if it's reached
+func WaitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(deadline.Sub(time.Now())):
+		return false
+	}
+}
+
+// num of queued items, in memory and on disk
+func (p *Pool) Pending() int {
+	ret := 0
+	for _, v := range p.queues {
+		ret += len(v.ch)
+		if v.spill != nil {
+			ret += v.spill.count()
+		}
+	}
+	return ret
+}
+
+// num of items spilled to disk
+func (p *Pool) Spilled() int {
+	ret := 0
+	for _, v := range p.queues {
+		if v.spill != nil {
+			ret += v.spill.count()
+		}
+	}
+	return ret
+}
+
+// stop accepting items and wait for the workers to drain the queues until
+// the deadline. returns the num of items left unhandled
+func (p *Pool) Close(deadline time.Time) int {
+	p.closeLock.Lock()
+	if p.closed {
+		p.closeLock.Unlock()
+		return p.Pending()
+	}
+	p.closed = true
+	close(p.closing)
+	p.closeLock.Unlock()
+
+	timeout := time.After(deadline.Sub(time.Now()))
+	done := make(chan bool)
+	go func() {
+		// the spilled items go back to the queues before they are closed
+		p.drainers.Wait()
+		for _, v := range p.queues {
+			if v.spill != nil {
+				v.spill.remove()
+			}
+			close(v.ch)
+		}
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-timeout:
+	}
+	// the items left on disk are discarded with their files
+	ret := p.Pending()
+	close(p.stop)
+	return ret
+}
+
+// pool statistics
+type Stat struct {
+	Policy              string
+	Pending, Spilled    int
+	SpilledBytes        int64
+	NumDropped          uint64
+	NumDroppedByDevices map[string]uint64
+}
+
+func (p *Pool) Stat() Stat {
+	ret := Stat{
+		Policy:              p.Opts.String(),
+		Pending:             p.Pending(),
+		Spilled:             p.Spilled(),
+		NumDropped:          atomic.LoadUint64(&p.NumDropped),
+		NumDroppedByDevices: p.Drops.Top(TOP_DROPS),
+	}
+	ret.SpilledBytes = atomic.LoadInt64(&p.spillBytes)
+	return ret
+}
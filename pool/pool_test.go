@@ -0,0 +1,226 @@
+package pool
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolOrderPerKey(t *testing.T) {
+	var lock sync.Mutex
+	got := make(map[string][]int)
+	p, err := New("test", 4, 100, Options{}, func(item interface{}) {
+		v := item.([2]interface{})
+		lock.Lock()
+		got[v[0].(string)] = append(got[v[0].(string)], v[1].(int))
+		lock.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 50; i++ {
+		for _, k := range keys {
+			p.Put(k, [2]interface{}{k, i})
+		}
+	}
+	if n := p.Close(time.Now().Add(time.Second)); n != 0 {
+		t.Fatal("items left:", n)
+	}
+
+	for _, k := range keys {
+		if len(got[k]) != 50 {
+			t.Fatal("key", k, "handled", len(got[k]))
+		}
+		for i, v := range got[k] {
+			if v != i {
+				t.Fatal("key", k, "out of order:", got[k])
+			}
+		}
+	}
+}
+
+// a pool with a worker held on its first item, and a queue of 2
+func blockedPool(t *testing.T, opts Options, handled *[]int) (*Pool, chan bool) {
+	block := make(chan bool)
+	first := true
+	p, err := New("test", 1, 2, opts, func(item interface{}) {
+		if first {
+			first = false
+			<-block
+		}
+		*handled = append(*handled, item.(int))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put("k", 0)
+	time.Sleep(10 * time.Millisecond)
+	if !p.Put("k", 1) || !p.Put("k", 2) {
+		t.Fatal("unexpected drop")
+	}
+	return p, block
+}
+
+func TestPoolPolicies(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		want   []int
+	}{
+		{"drop-oldest", []int{0, 2, 3}},
+		{"drop-newest", []int{0, 1, 2}},
+		{"block:10ms", []int{0, 1, 2}},
+	} {
+		opts, err := ParsePolicy(c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handled := make([]int, 0)
+		p, block := blockedPool(t, opts, &handled)
+		if p.Put("k", 3) {
+			t.Error(c.policy, "overflow not reported")
+		}
+		if p.NumDropped != 1 || p.Drops.Get("k") != 1 {
+			t.Error(c.policy, "dropped:", p.NumDropped, p.Drops.Top(1))
+		}
+		close(block)
+		p.Close(time.Now().Add(time.Second))
+		if len(handled) != len(c.want) {
+			t.Fatal(c.policy, "handled:", handled)
+		}
+		for i := range c.want {
+			if handled[i] != c.want[i] {
+				t.Fatal(c.policy, "handled:", handled)
+			}
+		}
+		if p.Put("k", 4) {
+			t.Error(c.policy, "put after close")
+		}
+	}
+
+	for _, v := range []string{"", "foo", "block:x", "block:-1s", "spill:1"} {
+		if _, err := ParsePolicy(v); err == nil {
+			t.Error("expected error for", v)
+		}
+	}
+}
+
+// a session end waiting for room must not hold the pool open
+func TestPoolPutWaitClose(t *testing.T) {
+	handled := make([]int, 0)
+	p, block := blockedPool(t, Options{Policy: DropNewest}, &handled)
+	var readers sync.WaitGroup
+	readers.Add(1)
+	put := true
+	go func() {
+		defer readers.Done()
+		put = p.PutWait("k", 3)
+	}()
+	if WaitUntil(&readers, time.Now().Add(20*time.Millisecond)) {
+		t.Fatal("expected the put to wait for room")
+	}
+	p.Close(time.Now().Add(20 * time.Millisecond))
+	if !WaitUntil(&readers, time.Now().Add(time.Second)) || put {
+		t.Fatal("expected the put to give up once closed")
+	}
+	close(block)
+}
+
+// the end of a session survives the items put after it
+func TestPoolPutWaitDropOldest(t *testing.T) {
+	for _, c := range []struct {
+		waits []int
+		want  []int
+	}{
+		{[]int{-1}, []int{0, -1, 5}},
+		// full of the entries to keep, the new items are dropped
+		{[]int{-1, -2}, []int{0, -1, -2}},
+	} {
+		block := make(chan bool)
+		handled := make([]int, 0)
+		p, err := New("test", 1, 2, Options{Policy: DropOldest}, func(item interface{}) {
+			if item.(int) == 0 {
+				<-block
+			}
+			handled = append(handled, item.(int))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put("k", 0)
+		time.Sleep(10 * time.Millisecond)
+		for _, v := range c.waits {
+			if !p.PutWait("k", v) {
+				t.Fatal("unexpected drop")
+			}
+		}
+		p.Put("k", 1)
+		for i := 2; i < 6; i++ {
+			if p.Put("k", i) {
+				t.Fatal(c.waits, "expected an overflow on", i)
+			}
+		}
+		close(block)
+		p.Close(time.Now().Add(time.Second))
+		if len(handled) != len(c.want) {
+			t.Fatal(c.waits, "handled:", handled)
+		}
+		for i := range c.want {
+			if handled[i] != c.want[i] {
+				t.Fatal(c.waits, "handled:", handled)
+			}
+		}
+	}
+}
+
+type intCodec struct{}
+
+func (intCodec) Encode(item interface{}) ([]byte, error) {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, uint64(item.(int)))
+	return ret, nil
+}
+
+func (intCodec) Decode(data []byte) (interface{}, error) {
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+func TestPoolSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts, _ := ParseOptions("spill", dir, 1, intCodec{})
+	handled := make([]int, 0)
+	p, block := blockedPool(t, opts, &handled)
+	for i := 3; i < 100; i++ {
+		if !p.Put("k", i) {
+			t.Fatal("spill failed")
+		}
+	}
+	if p.Spilled() == 0 {
+		t.Fatal("nothing spilled")
+	}
+
+	close(block)
+	if n := p.Close(time.Now().Add(time.Second)); n != 0 {
+		t.Fatal("items left:", n)
+	}
+	if len(handled) != 100 {
+		t.Fatal("handled:", len(handled))
+	}
+	for i, v := range handled {
+		if v != i {
+			t.Fatal("out of order:", handled)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("spill files left")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package pool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// the overflow of one queue, records are appended and read back in order:
+// | total len, 4 bytes | key len, 2 bytes | key | encoded item |
+// the file is truncated whenever it has been read up. spilled items only
+// live as long as the process, the file of a previous run is discarded
+type spillFile struct {
+	p      *Pool
+	q      *queue
+	path   string
+	f      *os.File
+	notify chan bool
+
+	lock       sync.Mutex
+	rOff, wOff int64
+	num        int
+}
+
+const SPILL_HEADER_LEN = 6
+
+func newSpillFile(p *Pool, q *queue, i int) (*spillFile, error) {
+	if p.Opts.Codec == nil {
+		return nil, errors.New("pool " + p.Name + ": spill policy without codec")
+	}
+	dir := p.Opts.SpillDir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, p.Name)
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d.spill", name, i))
+	if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+		log.Warn("discarding the spill file of a previous run: ", path, ", ", st.Size(), " bytes")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{p: p, q: q, path: path, f: f, notify: make(chan bool, 1)}, nil
+}
+
+// queue the entry, to the file if it's not empty or the queue is full so
+// the order is kept. false if the entry can't be spilled
+func (s *spillFile) put(e entry) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.num == 0 {
+		select {
+		case s.q.ch <- e:
+			return true
+		default:
+		}
+	}
+
+	data, err := s.p.Opts.Codec.Encode(e.item)
+	if err != nil {
+		log.Error("pool ", s.p.Name, ": can't spill item of ", e.key, ": ", err)
+		return false
+	}
+	key := e.key
+	if len(key) > 0xffff {
+		key = key[:0xffff]
+	}
+	n := SPILL_HEADER_LEN + len(key) + len(data)
+	max := s.p.Opts.SpillMaxBytes
+	if max > 0 && atomic.LoadInt64(&s.p.spillBytes)+int64(n) > max {
+		log.Warn("pool ", s.p.Name, ": spill files full, ", max, " bytes")
+		return false
+	}
+
+	rec := make([]byte, n)
+	binary.BigEndian.PutUint32(rec, uint32(n))
+	binary.BigEndian.PutUint16(rec[4:], uint16(len(key)))
+	copy(rec[SPILL_HEADER_LEN:], key)
+	copy(rec[SPILL_HEADER_LEN+len(key):], data)
+	if _, err := s.f.WriteAt(rec, s.wOff); err != nil {
+		log.Error("pool ", s.p.Name, ": ", err)
+		return false
+	}
+	s.wOff += int64(n)
+	s.num++
+	atomic.AddInt64(&s.p.spillBytes, int64(n))
+
+	select {
+	case s.notify <- true:
+	default:
+	}
+	return true
+}
+
+// the first record on the file without consuming it, its length is
+// returned for consume(). n is 0 if the file is empty
+func (s *spillFile) next() (e entry, n int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.num == 0 {
+		return
+	}
+
+	header := make([]byte, SPILL_HEADER_LEN)
+	if _, err = s.f.ReadAt(header, s.rOff); err != nil {
+		return
+	}
+	total := int64(binary.BigEndian.Uint32(header))
+	keyLen := int64(binary.BigEndian.Uint16(header[4:]))
+	if total < SPILL_HEADER_LEN+keyLen || s.rOff+total > s.wOff {
+		err = errors.New("corrupted spill file " + s.path)
+		return
+	}
+	rec := make([]byte, total-SPILL_HEADER_LEN)
+	if _, err = s.f.ReadAt(rec, s.rOff+SPILL_HEADER_LEN); err != nil {
+		return
+	}
+	n = total
+	e.key = string(rec[:keyLen])
+	if e.item, err = s.p.Opts.Codec.Decode(rec[keyLen:]); err != nil {
+		log.Error("pool ", s.p.Name, ": can't decode spilled item of ", e.key, ": ", err)
+		e.item, err = nil, nil
+	}
+	return
+}
+
+func (s *spillFile) consume(n int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rOff += n
+	s.num--
+	atomic.AddInt64(&s.p.spillBytes, -n)
+	if s.num == 0 {
+		// read up, reuse the file from the start
+		s.rOff, s.wOff = 0, 0
+		if err := s.f.Truncate(0); err != nil {
+			log.Error("pool ", s.p.Name, ": ", err)
+		}
+	}
+}
+
+// discard all the records, on unrecoverable errors
+func (s *spillFile) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log.Error("pool ", s.p.Name, ": ", s.num, " spilled items discarded")
+	atomic.AddUint64(&s.p.NumDropped, uint64(s.num))
+	atomic.AddInt64(&s.p.spillBytes, s.rOff-s.wOff)
+	s.rOff, s.wOff, s.num = 0, 0, 0
+	s.f.Truncate(0)
+}
+
+func (s *spillFile) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.num
+}
+
+func (s *spillFile) remove() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.f.Close()
+	os.Remove(s.path)
+}
+
+// move the spilled items of the queue back to it in order, exits once
+// the pool is closed and the file read up, or on the shutdown deadline
+func (p *Pool) drainer(q *queue) {
+	defer p.drainers.Done()
+	s := q.spill
+	for {
+		e, n, err := s.next()
+		if err != nil {
+			s.reset()
+			continue
+		}
+		if n == 0 {
+			select {
+			case <-p.closing:
+				if s.count() == 0 {
+					return
+				}
+			case <-s.notify:
+			case <-p.stop:
+				return
+			}
+			continue
+		}
+		if e.item == nil {
+			// undecodable or gone, drop it
+			s.consume(n)
+			p.drop(e.key)
+			continue
+		}
+
+		select {
+		case q.ch <- e:
+			s.consume(n)
+		case <-p.stop:
+			return
+		}
+	}
+}
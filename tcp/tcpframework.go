@@ -7,53 +7,84 @@
 package tcp
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"lbsas/admin"
+	dbh "lbsas/database"
 	. "lbsas/datatypes"
-	"lbsas/utils"
+	"lbsas/pool"
 	"net"
-	"net/http"
-	"os"
-	"runtime"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gorilla/mux"
 )
 
 // globals
 type TCPServer struct {
-	v                    Vendor
-	StatTcp, StatTcpLast NetStatus
-	Reportor             *log.Logger
+	v       Vendor
+	StatTcp NetStatus
+
+	// workers shared by all the sessions, sharded by device
+	pool *pool.Pool
+
+	// sessions by id, until their last packets are handled
+	listener net.Listener
+	sessions map[uint64]net.Conn
+	lastId   uint64
+	lock     sync.Mutex
+	closing  bool
+	readers  sync.WaitGroup
+}
+
+// a packet of a session on the worker queues, or the end of the session
+// if buff is nil
+type item struct {
+	id   uint64
+	conn net.Conn
+	buff []byte
+}
+
+// statistics served by the admin server
+type Status struct {
+	NetStatus
+	Queue pool.Stat
 }
 
 // main
 func New(v Vendor) *TCPServer {
-	reportor := log.New()
-	f, err := os.Create("report.log")
-	if err != nil {
-		log.Fatal(err)
-	}
-	reportor.Out = f
 	log.SetLevel(v.GetCfg().LogLevel)
 	log.SetFormatter(&log.TextFormatter{})
-	reportor.Level = log.DebugLevel
 
-	ret := &TCPServer{v, NetStatus{}, NetStatus{}, reportor}
-	go ret.statusReport()
+	ret := &TCPServer{v: v, sessions: make(map[uint64]net.Conn)}
+	opts, e := pool.ParseOptions(v.GetCfg().QueuePolicy, v.GetCfg().SpillDir, v.GetCfg().SpillMaxMB, codec{ret})
+	if e != nil {
+		log.Fatal(ret.Name(), ": ", e)
+	}
+	ret.pool, e = pool.New(ret.Name(), v.GetCfg().WorkerNum, v.GetCfg().ChanSize, opts, ret.handle)
+	if e != nil {
+		log.Fatal(ret.Name(), ": ", e)
+	}
+
+	a, e := net.ResolveTCPAddr(v.GetCfg().Protocol, v.GetCfg().Addr)
+	if e != nil {
+		log.Fatal(e)
+	}
+	var l net.Listener
+	l, e = net.ListenTCP(v.GetCfg().Protocol, a)
+	if e != nil {
+		log.Panic(e)
+	}
+	if v.GetCfg().TLSConfig != nil {
+		l = tls.NewListener(l, v.GetCfg().TLSConfig)
+	}
+	ret.listener = l
 
 	// log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
 	// !!!! MAIN !!!!
 	go func() {
-		a, e := net.ResolveTCPAddr(v.GetCfg().Protocol, v.GetCfg().Addr)
-		if e != nil {
-			log.Fatal(e)
-		}
-		l, e := net.ListenTCP(v.GetCfg().Protocol, a)
-		if e != nil {
-			log.Panic(e)
-		}
 		//
 		defer l.Close()
 		defer v.Close()
@@ -61,6 +92,9 @@ func New(v Vendor) *TCPServer {
 		for {
 			c, e := l.Accept()
 			if e != nil {
+				if ret.isClosing() {
+					return
+				}
 				log.Error(e)
 				continue
 			}
@@ -75,29 +109,114 @@ func New(v Vendor) *TCPServer {
 	ret.StatTcp.LastTime = time.Now()
 	ret.StatTcp.NowTime = ret.StatTcp.LastTime
 	ret.StatTcp.StartTime = ret.StatTcp.LastTime
-	ret.StatTcpLast.LastTime = ret.StatTcp.LastTime
-	ret.StatTcpLast.NowTime = ret.StatTcp.LastTime
-	ret.StatTcpLast.StartTime = ret.StatTcp.LastTime
 
-	// start the embedded web server
-	r := mux.NewRouter()
-	r.HandleFunc("/api/{component}", ret._apiHandlerTcp)
-	http.Handle("/", r)
-	go http.ListenAndServe(v.GetCfg().HttpAddr, nil)
+	// statistics are served by the shared embedded web server
+	admin.Register(ret)
 
 	return ret
 }
 
+func (s *TCPServer) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// stop accepting connections, close the sessions and wait for the vendor
+// workers to handle the queued packets until the deadline.
+// returns the num of packets left unhandled
+func (s *TCPServer) Shutdown(deadline time.Time) int {
+	s.lock.Lock()
+	s.closing = true
+	s.listener.Close()
+	for _, conn := range s.sessions {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	// the readers queue their last packets before exiting, those still
+	// waiting for room at the deadline give up once the pool is closed
+	if !pool.WaitUntil(&s.readers, deadline) {
+		log.Warn(s.Name(), " shutdown deadline reached, the sessions ending are not queued")
+	}
+	pending := s.pool.Close(deadline)
+	if pending > 0 {
+		log.Error(s.Name(), " shutdown deadline reached, ", pending, " packets left")
+	}
+	return pending
+}
+
+// called by the pool workers: a packet to handle, or the end of a closed
+// session queued after its last packet
+func (s *TCPServer) handle(v interface{}) {
+	it := v.(*item)
+	if it.buff != nil {
+		s.v.HandlePacket(&RawTcpPacket{Buff: it.buff, Conn: &it.conn})
+		return
+	}
+	dbh.Offline(it.conn)
+	s.lock.Lock()
+	delete(s.sessions, it.id)
+	s.lock.Unlock()
+}
+
+// serializes the items spilled to disk, the conn is kept in memory
+type codec struct {
+	s *TCPServer
+}
+
+func (c codec) Encode(v interface{}) ([]byte, error) {
+	it := v.(*item)
+	ret := make([]byte, 9+len(it.buff))
+	binary.BigEndian.PutUint64(ret, it.id)
+	if it.buff != nil {
+		ret[8] = 1
+		copy(ret[9:], it.buff)
+	}
+	return ret, nil
+}
+
+func (c codec) Decode(data []byte) (interface{}, error) {
+	if len(data) < 9 {
+		return nil, errors.New("invalid item")
+	}
+	it := &item{id: binary.BigEndian.Uint64(data)}
+	if data[8] == 1 {
+		it.buff = data[9:]
+	}
+	c.s.lock.Lock()
+	conn, ok := c.s.sessions[it.id]
+	c.s.lock.Unlock()
+	if !ok {
+		return nil, errors.New("session gone")
+	}
+	it.conn = conn
+	return it, nil
+}
+
 // tcp session handler
 func (s *TCPServer) tcpStartSession(conn net.Conn) {
 	defer conn.Close()
 
-	// channel to cache packets when the far-end device is busy sending
-	packetsChan := make(chan *RawTcpPacket, s.v.GetCfg().ChanSize)
-	defer close(packetsChan)
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return
+	}
+	s.lastId++
+	id := s.lastId
+	s.sessions[id] = conn
+	s.readers.Add(1)
+	s.lock.Unlock()
 
-	// create a default worker
-	go s.v.TcpWorker(packetsChan)
+	// packets of the session are queued under the device key, until the
+	// device is known the remote address is used
+	key := conn.RemoteAddr().String()
+	defer func() {
+		// the session goes offline after its queued packets are handled
+		s.pool.PutWait(key, &item{id: id, conn: conn})
+		s.readers.Done()
+	}()
 
 	var (
 		last, n, status int
@@ -150,26 +269,17 @@ func (s *TCPServer) tcpStartSession(conn net.Conn) {
 		} else {
 			// we got a whole peacket here
 			s.StatTcp.NumPktsReceived++
-			packet := &RawTcpPacket{make([]byte, last+n), &conn}
-			copy(packet.Buff, buff[:last+n])
+			packet := &item{id: id, conn: conn, buff: make([]byte, last+n)}
+			copy(packet.buff, buff[:last+n])
 			// reset counters
 			n, last, whole = 0, 0, true
 
-			// insert into the chan
-			select {
-			case packetsChan <- packet:
-			default:
-				// TODO: two approches to handle this situation
-				// 1) just drop the oldest msg and insert the new one
-				// 2) create a now worker on the channel and insert again
-				// Currently the first one is applied; the second approche can
-				// be a feature in future release, and it's required
-				// to release long-time-ide workers [IMPORTANT feature]
-
-				<-packetsChan
-				packetsChan <- packet
+			if k := s.v.DeviceKey(packet.buff); k != "" {
+				key = k
+			}
+			// insert into the worker queue, overflows are handled by the policy
+			if !s.pool.Put(key, packet) {
 				s.StatTcp.NumPktsDroped++
-				// TODO
 				log.Error("Receiv buff overflow. From:", conn.RemoteAddr(), ", Buff size:", s.v.GetCfg().ChanSize)
 			}
 		}
@@ -184,42 +294,20 @@ func (s *TCPServer) tcpStartSession(conn net.Conn) {
 	s.StatTcp.NumConnClosed++
 }
 
-// code for statistics, just skip it
-func (s *TCPServer) _apiHandlerTcp(w http.ResponseWriter, r *http.Request) {
-
-	var ret []byte
-	if w != nil && r != nil {
-		vars := mux.Vars(r)
-		coapi := vars["component"]
-		switch coapi {
-		case "tcpstatus":
-			//
-		case "set":
-			lvl, err := utils.String2LogLevel(r.FormValue("loglevel"))
-			if err == nil {
-				log.SetLevel(lvl)
-				s.v.SetLogLevel(lvl)
-			}
-			ret = []byte("{\"success\":true, \"msg\":\"loglevel set success\"}")
-
-		default:
-			ret = []byte("{\"success\":false, \"msg\":\"unknown api\"}")
-
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
-	} else {
-	}
+func (s *TCPServer) Name() string {
+	return s.v.GetCfg().Vendor + "@" + s.v.GetCfg().Addr
 }
 
-// timer triggered every 120s to report statistics
-func (s *TCPServer) statusReport() {
-	s.Reportor.Info("Report starting")
-	timeChan := time.NewTicker(time.Second * 120).C
-	for {
-		<-timeChan
-		runtime.ReadMemStats(&s.StatTcpLast.MemStat)
-		s._apiHandlerTcp(nil, nil)
-	}
-	s.Reportor.Info("Report ended")
+// code for statistics, just skip it
+func (s *TCPServer) Status() interface{} {
+	stat := s.StatTcp
+	stat.NowTime = time.Now()
+	stat.NumConnActive = stat.NumConnCreated - stat.NumConnClosed
+	vstat := s.v.GetStat()
+	stat.NumInvalidPackets = vstat.NumInvalidPackets
+	stat.AvgWorkerTimeMicroSec = vstat.AvgWorkerTimeMicroSec
+	stat.AvgDBTimeMicroSec = vstat.AvgDBTimeMicroSec
+	stat.NumDBWriteMsgCacheSize = vstat.DBWriteMsgCacheSize
+	stat.NumDBWriteMsgDropped = vstat.DBWriteMsgDropped
+	return Status{stat, s.pool.Stat()}
 }
@@ -7,28 +7,76 @@
 package tcp2
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"lbsas/admin"
 	dbh "lbsas/database"
 	. "lbsas/datatypes"
-	"lbsas/utils"
+	"lbsas/pool"
 	"net"
-	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gorilla/mux"
 )
 
 const (
-	MAX_PACKET_LEN = 260
+	MAX_PACKET_LEN = 512
+	// bytes needed to tell the protocol of a connection
+	DETECT_LEN = 16
 )
 
 // globals
-var gEnv *EnviromentCfg = nil
-var gProtoList []dbh.IGPSProto = nil
+var gProtoList []protoEntry = nil
 var gDBHelper *dbh.DbHelper = nil
 
+// vendor name of the listener serving all registered protocols
+const VENDOR_AUTO = "auto"
+
+type protoEntry struct {
+	vendor string
+	proto  dbh.IGPSProto
+}
+
+// one server per listener, env.TCPAddr is the listening address.
+// env.DType selects the registered protocols to detect, VENDOR_AUTO for all
 type TCPServer struct {
+	env    EnviromentCfg
+	Stat   NetStatus
+	protos []dbh.IGPSProto
+
+	// workers shared by all the sessions, sharded by device
+	pool *pool.Pool
+
+	// sessions by id, until their last packets are handled
+	listener net.Listener
+	sessions map[uint64]*session
+	lastId   uint64
+	lock     sync.Mutex
+	closing  bool
+	readers  sync.WaitGroup
+}
+
+type session struct {
+	conn  net.Conn
+	proto dbh.IGPSProto
+}
+
+// a packet of a session on the worker queues, or the end of the session
+// if proto is nil
+type item struct {
+	id    uint64
+	conn  net.Conn
+	proto dbh.IGPSProto
+	buff  []byte
+}
+
+// statistics served by the admin server
+type Status struct {
+	NetStatus
+	Queue pool.Stat
 }
 
 // main
@@ -36,10 +84,6 @@ func New(env EnviromentCfg) *TCPServer {
 	log.SetLevel(env.LogLevel)
 	log.SetFormatter(&log.TextFormatter{})
 
-	if gEnv == nil {
-		gEnv = &env
-	}
-
 	if gDBHelper == nil {
 		gDBHelper = dbh.New(env)
 		if gDBHelper == nil {
@@ -47,55 +91,137 @@ func New(env EnviromentCfg) *TCPServer {
 		}
 	}
 
-	ret := &TCPServer{}
+	ret := &TCPServer{env: env, sessions: make(map[uint64]*session)}
+	ret.Stat.StartTime = time.Now()
+	for _, v := range gProtoList {
+		if env.DType == VENDOR_AUTO || env.DType == v.vendor {
+			ret.protos = append(ret.protos, v.proto)
+		}
+	}
+	if len(ret.protos) == 0 {
+		log.Fatal("no protocol registered for: ", env.DType)
+	}
+
+	opts, e := pool.ParseOptions(env.QueuePolicy, env.SpillDir, env.SpillMaxMB, codec{ret})
+	if e != nil {
+		log.Fatal(ret.Name(), ": ", e)
+	}
+	ret.pool, e = pool.New(ret.Name(), env.NumWorkersPerConn, env.QueueSizePerConn, opts, ret.handle)
+	if e != nil {
+		log.Fatal(ret.Name(), ": ", e)
+	}
+
+	a, e := net.ResolveTCPAddr("tcp", env.TCPAddr)
+	if e != nil {
+		log.Fatal(e)
+	}
+	var l net.Listener
+	l, e = net.ListenTCP("tcp", a)
+	if e != nil {
+		log.Panic(e)
+	}
+	if env.TLSConfig != nil {
+		l = tls.NewListener(l, env.TLSConfig)
+	}
+	ret.listener = l
 
 	go func() {
-		a, e := net.ResolveTCPAddr("tcp", env.TCPAddr)
-		if e != nil {
-			log.Fatal(e)
-		}
-		l, e := net.ListenTCP("tcp", a)
-		if e != nil {
-			log.Panic(e)
-		}
 		//
 		defer l.Close()
-		defer gDBHelper.Close()
 
 		for {
 			c, e := l.Accept()
 			if e != nil {
+				if ret.isClosing() {
+					return
+				}
 				log.Error(e)
 				continue
 			}
-			go tcpStartSession(c)
+			ret.Stat.NumConnCreated++
+			go ret.tcpStartSession(c)
 		}
 	}()
 
-	// start the embedded web server
-	r := mux.NewRouter()
-	r.HandleFunc("/api/{component}", ret._apiHandlerTcp)
-	http.Handle("/", r)
-	go http.ListenAndServe(gEnv.HTTPAddr, nil)
+	// statistics are served by the shared embedded web server
+	admin.Register(ret)
 
 	return ret
 }
 
-func Register(v dbh.IGPSProto) {
+func Register(vendor string, v dbh.IGPSProto) {
 	log.Debug("gprotolist: ", gProtoList, "len:", len(gProtoList), ", cap: ", cap(gProtoList))
-	gProtoList = append(gProtoList, v)
-	log.Debug("registered: ", v)
+	gProtoList = append(gProtoList, protoEntry{vendor, v})
+	log.Debug("registered: ", vendor, " ", v)
+}
+
+// try every protocol of the listener on the first bytes
+func (s *TCPServer) detect(buff []byte, conn *net.Conn) dbh.IGPSProto {
+	for _, v := range s.protos {
+		t := v.New(buff, conn)
+		if t != nil && t.IsValid() {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *TCPServer) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// stop accepting connections, close the sessions and wait for the workers
+// to handle the queued packets until the deadline.
+// returns the num of packets left unhandled
+func (s *TCPServer) Shutdown(deadline time.Time) int {
+	s.lock.Lock()
+	s.closing = true
+	s.listener.Close()
+	for _, v := range s.sessions {
+		v.conn.Close()
+	}
+	s.lock.Unlock()
+
+	// the readers queue their last packets before exiting, those still
+	// waiting for room at the deadline give up once the pool is closed
+	if !pool.WaitUntil(&s.readers, deadline) {
+		log.Warn(s.Name(), " shutdown deadline reached, the sessions ending are not queued")
+	}
+	pending := s.pool.Close(deadline)
+	if pending > 0 {
+		log.Error(s.Name(), " shutdown deadline reached, ", pending, " packets left")
+	}
+	return pending
 }
 
 // tcp session handler
-func tcpStartSession(conn net.Conn) {
+func (s *TCPServer) tcpStartSession(conn net.Conn) {
 	defer conn.Close()
-	packetsChan := make(chan dbh.IGPSProto, gEnv.QueueSizePerConn)
-	defer close(packetsChan)
 	var proto dbh.IGPSProto = nil
 	var protoTmp dbh.IGPSProto = nil
 
-	go tcpWorker(packetsChan)
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return
+	}
+	s.lastId++
+	id := s.lastId
+	sess := &session{conn: conn}
+	s.sessions[id] = sess
+	s.readers.Add(1)
+	s.lock.Unlock()
+
+	// packets of the session are queued under the device key, until the
+	// device is known the remote address is used
+	key := conn.RemoteAddr().String()
+	defer func() {
+		// the session goes offline after its queued packets are handled
+		s.pool.PutWait(key, &item{id: id, conn: conn})
+		s.readers.Done()
+	}()
 
 	var (
 		last, n int
@@ -110,120 +236,154 @@ func tcpStartSession(conn net.Conn) {
 	// block readings on the tcp socket
 	for {
 		// set read timeout
-		conn.SetReadDeadline(time.Now().Add(time.Duration(gEnv.TCPTimeOutSec) * time.Second))
+		conn.SetReadDeadline(time.Now().Add(time.Duration(s.env.TCPTimeOutSec) * time.Second))
 		n, err = conn.Read(buff[last:])
 		if err != nil {
+			s.Stat.NumErrorRcv++
 			break
 		}
 		if n == 0 {
 			log.Debug("empty packet, continue")
 			continue
 		}
-		//
+		last += n
+
+		// the protocol is detected on the first bytes of the connection
 		if proto == nil {
-			for k, v := range gProtoList {
-				if v == nil {
-					log.Error("nil proto ", k)
+			proto = s.detect(buff[:last], &conn)
+			if proto == nil {
+				if last < DETECT_LEN {
 					continue
 				}
-				log.Debug("v: ", v)
-				t := v.New(buff[:last+n], &conn)
-				if t.IsValid() {
-					proto = t
-					break
-				}
+				s.Stat.NumInvalidPkts++
+				log.Error("protocol not supported: ", hex.EncodeToString(buff[:last]))
+				break
 			}
-		} else {
-			proto = proto.New(buff[:last+n], conn)
+			s.lock.Lock()
+			sess.proto = proto
+			s.lock.Unlock()
 		}
 
-		if proto == nil {
-			log.Error("protocol not supported: ", hex.EncodeToString(buff[:last+n]))
-			return
-		}
-
-		whole := proto.IsWhole()
-		if whole < 0 {
-			last += n
-			log.Debug("not whole packet:", proto)
-		} else {
-			if whole == 0 {
-				tmp := make([]byte, MAX_PACKET_LEN)
-				copy(tmp, buff)
-				protoTmp = proto.New(tmp)
-
-			} else {
-				protoTmp = proto.New(buff[:len(buff)-whole])
-				tmp := make([]byte, MAX_PACKET_LEN)
-				copy(tmp, buff[len(buff)-whole:])
-				buff = tmp
+		// there may be several whole packets in the buffer
+		for last > 0 {
+			whole := proto.New(buff[:last], &conn).IsWhole()
+			if whole < 0 {
+				log.Debug("not whole packet:", hex.EncodeToString(buff[:last]))
+				break
+			}
+			end := last - whole
+			if end <= 0 {
+				err = errors.New("invalid packet: " + hex.EncodeToString(buff[:last]))
+				goto TEARDOWN
 			}
+			packet := make([]byte, end)
+			copy(packet, buff[:end])
+			copy(buff, buff[end:last])
 			// reset last
 			last = whole
+			s.Stat.NumPktsReceived++
+			protoTmp = proto.New(packet, &conn)
+			if k := protoTmp.DeviceKey(); k != "" {
+				key = k
+			}
 
-			select {
-			case packetsChan <- protoTmp:
-			default:
-				<-packetsChan
-				packetsChan <- protoTmp
+			if !s.pool.Put(key, &item{id: id, conn: conn, proto: protoTmp, buff: packet}) {
+				s.Stat.NumPktsDroped++
 				log.Error("Receiv buff overflow. From:", conn.RemoteAddr(), ", proto: ", proto)
 			}
 		}
+
+		if last == len(buff) {
+			s.Stat.NumInvalidPkts++
+			err = errors.New("packet too long: " + hex.EncodeToString(buff))
+			break
+		}
 	}
 
+TEARDOWN:
 	// teardown
 	// we are not interested in EOF
 	if err != nil && err.Error() != "EOF" {
 		// aliyun finance ECS is always connecting ports shortly to check status
 		log.Debug(err)
 	}
+	s.Stat.NumConnClosed++
 }
 
-func (s *TCPServer) _apiHandlerTcp(w http.ResponseWriter, r *http.Request) {
-	var ret []byte
-	vars := mux.Vars(r)
-	coapi := vars["component"]
-	switch coapi {
-	case "tcpstatus":
-		ret = []byte("{\"success\":true, \"msg\":\"loglevel set success\"}")
-	case "set":
-		lvl, err := utils.String2LogLevel(r.FormValue("loglevel"))
-		if err == nil {
-			log.SetLevel(lvl)
+func (s *TCPServer) Name() string {
+	return s.env.DType + "@" + s.env.TCPAddr
+}
+
+func (s *TCPServer) Status() interface{} {
+	stat := s.Stat
+	stat.NowTime = time.Now()
+	stat.NumConnActive = stat.NumConnCreated - stat.NumConnClosed
+	return Status{stat, s.pool.Stat()}
+}
+
+// called by the pool workers: a packet to handle, or the end of a closed
+// session queued after its last packet
+func (s *TCPServer) handle(v interface{}) {
+	it := v.(*item)
+	if it.proto == nil {
+		dbh.Offline(it.conn)
+		s.lock.Lock()
+		delete(s.sessions, it.id)
+		s.lock.Unlock()
+		return
+	}
+
+	proto := it.proto
+	if proto.HandleMsg() {
+		if gDBHelper.Put(proto.DeviceKey(), proto) {
+			log.Debug("inserted in to dbcache: ", proto)
+		} else {
+			s.Stat.NumDBWriteMsgDropped++
+			log.Warn("DBMsgChan overflow")
 		}
-		ret = []byte("{\"success\":true, \"msg\":\"loglevel set success\"}")
+	}
+}
 
-	default:
-		ret = []byte("{\"success\":false, \"msg\":\"unknown api\"}")
+// serializes the items spilled to disk, the conn and the detected protocol
+// are kept in memory
+type codec struct {
+	s *TCPServer
+}
 
+func (c codec) Encode(v interface{}) ([]byte, error) {
+	it := v.(*item)
+	ret := make([]byte, 9+len(it.buff))
+	binary.BigEndian.PutUint64(ret, it.id)
+	if it.proto != nil {
+		ret[8] = 1
+		copy(ret[9:], it.buff)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(ret)
+	return ret, nil
 }
 
-func tcpWorker(packetsChan chan dbh.IGPSProto) {
-	for {
-		proto := <-packetsChan
-		if proto == nil {
-			return
-		}
-		if proto.HandleMsg() {
-			for {
-				select {
-				case gDBHelper.DBMsgChan <- proto:
-					log.Debug("inserted in to dbcache: ", proto)
-					goto BREAK_
-				default:
-					<-gDBHelper.DBMsgChan
-					log.Warn("DBMsgChan overflow")
-				}
-			}
-		BREAK_:
+func (c codec) Decode(data []byte) (interface{}, error) {
+	if len(data) < 9 {
+		return nil, errors.New("invalid item")
+	}
+	it := &item{id: binary.BigEndian.Uint64(data)}
+	c.s.lock.Lock()
+	sess, ok := c.s.sessions[it.id]
+	c.s.lock.Unlock()
+	if !ok {
+		return nil, errors.New("session gone")
+	}
+	it.conn = sess.conn
+	if data[8] == 1 {
+		if sess.proto == nil {
+			return nil, errors.New("protocol unknown")
 		}
+		it.buff = data[9:]
+		it.proto = sess.proto.New(it.buff, &it.conn)
 	}
+	return it, nil
 }
 
 func init() {
-	gProtoList = make([]dbh.IGPSProto, 0)
+	gProtoList = make([]protoEntry, 0)
 	log.Debug("framework inited")
 }
@@ -8,32 +8,37 @@ package udp
 
 import (
 	"encoding/hex"
-	"fmt"
+	"errors"
+	"lbsas/admin"
 	dbh "lbsas/database"
 	. "lbsas/datatypes"
+	"lbsas/pool"
 	"lbsas/vendors/ty905"
 	"net"
-	"net/http"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-
-	"github.com/gorilla/mux"
 )
 
 var GProtoList []dbh.IGPSProto = nil
 var DBHelper *dbh.DbHelper = nil
 
+// one server per listener, Env.TCPAddr is the listening address
 type UDPServer struct {
-	Env EnviromentCfg
-}
+	Env  EnviromentCfg
+	Stat NetStatus
 
-var _udpServer *UDPServer = nil
+	// workers sharded by device, so the packets of one device are handled in order
+	pool *pool.Pool
 
-func New(env EnviromentCfg) *UDPServer {
-	if _udpServer != nil {
-		return _udpServer
-	}
+	// for shutdown
+	conn    *net.UDPConn
+	closing bool
+	reader  sync.WaitGroup
+}
 
+func New(env EnviromentCfg) *UDPServer {
 	var err error = nil
 	DBHelper = dbh.New(env)
 	if DBHelper == nil {
@@ -43,8 +48,8 @@ func New(env EnviromentCfg) *UDPServer {
 
 	//
 	GProtoList = []dbh.IGPSProto{ty905.New(RawUdpPacket{})}
-	_udpServer = &UDPServer{env}
-	ret := _udpServer
+	ret := &UDPServer{Env: env}
+	ret.Stat.StartTime = time.Now()
 	udpAddr, err := net.ResolveUDPAddr("udp", ret.Env.TCPAddr)
 	if err != nil {
 		log.Error(err)
@@ -57,81 +62,140 @@ func New(env EnviromentCfg) *UDPServer {
 		return nil
 	}
 
-	var packetsChan = make(chan RawUdpPacket, ret.Env.MsgCacheSize)
-
-	for i := 0; i < ret.Env.NumUDPWokers; i++ {
-		go worker(packetsChan)
+	ret.conn = udpConn
+	workers := ret.Env.NumUDPWokers
+	if workers < 1 {
+		workers = 1
+	}
+	opts, err := pool.ParseOptions(env.QueuePolicy, env.SpillDir, env.SpillMaxMB, codec{udpConn})
+	if err == nil {
+		ret.pool, err = pool.New(ret.Name(), workers, int(ret.Env.MsgCacheSize)/workers, opts, ret.worker)
+	}
+	if err != nil {
+		log.Error(ret.Name(), ": ", err)
+		udpConn.Close()
+		return nil
 	}
 
-	log.Info("dbcache size:", ret.Env.MsgCacheSize, " udp worker num:", ret.Env.NumUDPWokers)
+	log.Info("dbcache size:", ret.Env.MsgCacheSize, " udp worker num:", workers)
 
 	// !!! MAIN !!!
+	ret.reader.Add(1)
 	go func() {
+		defer ret.reader.Done()
 		for {
 			var rawPacket RawUdpPacket
 			rawPacket.Buff = make([]byte, 160)
 			log.Debug("waiting packets...")
-			_, remote, err := udpConn.ReadFromUDP(rawPacket.Buff)
+			n, remote, err := udpConn.ReadFromUDP(rawPacket.Buff)
 			if err != nil {
+				if ret.closing {
+					return
+				}
+				ret.Stat.NumErrorRcv++
 				log.Debug("Error Reading")
 			} else {
+				ret.Stat.NumPktsReceived++
+				// the rest of the buffer is not part of the packet
+				rawPacket.Buff = rawPacket.Buff[:n]
 				rawPacket.Remote = remote
 				rawPacket.UdpConn = udpConn
 				log.Debug(hex.Dump(rawPacket.Buff))
-				select {
-				case packetsChan <- rawPacket:
-				default:
-					<-packetsChan
-					packetsChan <- rawPacket
+				key := remote.String()
+				if t := GProtoList[0].New(rawPacket); t != nil {
+					key = t.DeviceKey()
+				}
+				if !ret.pool.Put(key, rawPacket) {
+					log.Debug("packet dropped, from: ", remote)
+					ret.Stat.NumPktsDroped++
 				}
 			}
 		}
 	}()
 
-	// start the embedded web server
-	r := mux.NewRouter()
-	r.HandleFunc("/api/{component}", _apiHandler)
-	http.Handle("/", r)
-	go http.ListenAndServe(env.HTTPAddr, nil)
+	// statistics are served by the shared embedded web server
+	admin.Register(ret)
 	return ret
 }
 
-func worker(packetsChan chan RawUdpPacket) {
-	for {
-		rawPacket := <-packetsChan
-		for _, v := range GProtoList {
-			t := v.New(rawPacket)
-			if t.IsValid() {
-				if t.HandleMsg() {
-					for {
-						select {
-						case DBHelper.DBMsgChan <- t:
-							log.Debug("inserted in to dbcache: ", t)
-							goto BREAK_
-						default:
-							<-DBHelper.DBMsgChan
-						}
-					}
-				BREAK_:
+// stop receiving and wait for the workers to handle the queued packets
+// until the deadline. returns the num of packets left unhandled
+func (s *UDPServer) Shutdown(deadline time.Time) int {
+	s.closing = true
+	s.conn.Close()
+
+	s.reader.Wait()
+	pending := s.pool.Close(deadline)
+	if pending > 0 {
+		log.Error(s.Name(), " shutdown deadline reached, ", pending, " packets left")
+	}
+	return pending
+}
+
+// called by the pool workers
+func (s *UDPServer) worker(item interface{}) {
+	rawPacket, ok := item.(RawUdpPacket)
+	if !ok {
+		return
+	}
+	valid := false
+	for _, v := range GProtoList {
+		t := v.New(rawPacket)
+		if t.IsValid() {
+			valid = true
+			if t.HandleMsg() {
+				if DBHelper.Put(t.DeviceKey(), t) {
+					log.Debug("inserted in to dbcache: ", t)
+				} else {
+					s.Stat.NumDBWriteMsgDropped++
 				}
-				break
 			}
+			break
 		}
 	}
+	if !valid {
+		s.Stat.NumInvalidPkts++
+	}
+}
+
+func (s *UDPServer) Name() string {
+	return s.Env.DType + "@" + s.Env.TCPAddr
 }
 
-func _apiHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	coapi := vars["component"]
-	var ret []byte
-	switch coapi {
-	case "stats":
-	default:
-		ret = []byte("{\"failed\":true, \"msg\":\"unknown api\"}")
+// statistics served by the admin server
+type Status struct {
+	NetStatus
+	Queue pool.Stat
+}
 
-	}
-	fmt.Println("web")
+func (s *UDPServer) Status() interface{} {
+	stat := s.Stat
+	stat.NowTime = time.Now()
+	return Status{stat, s.pool.Stat()}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(ret)
+// serializes the packets spilled to disk: remote addr len, remote addr, buff
+type codec struct {
+	conn *net.UDPConn
+}
+
+func (c codec) Encode(v interface{}) ([]byte, error) {
+	rp := v.(RawUdpPacket)
+	addr := rp.Remote.String()
+	ret := make([]byte, 1+len(addr)+len(rp.Buff))
+	ret[0] = byte(len(addr))
+	copy(ret[1:], addr)
+	copy(ret[1+len(addr):], rp.Buff)
+	return ret, nil
+}
+
+func (c codec) Decode(data []byte) (interface{}, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errors.New("invalid packet")
+	}
+	remote, err := net.ResolveUDPAddr("udp", string(data[1:1+data[0]]))
+	if err != nil {
+		return nil, err
+	}
+	return RawUdpPacket{Buff: data[1+data[0]:], Remote: remote, UdpConn: c.conn}, nil
 }
@@ -8,6 +8,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"time"
 
@@ -23,6 +24,24 @@ func GetTimestampFromString(tm []byte) time.Time {
 		return time.Now()
 	}
 
+	t, err := ParseTimestamp(tm)
+	if err != nil {
+		t = time.Now()
+		log.Error(err)
+	} else if math.Abs(float64(t.Unix()-time.Now().Unix())) > SECS_15MINUTE {
+		// TODO: THIS SHOULD BE TAKEN CARED BY THE APPLICATIONS OF GPS DATA, NOT THE ACCESS SERVER ITSELF
+		t = time.Now()
+	}
+
+	return t
+}
+
+// YYYYMMDDHHMMSS in UTC as is, for the reports buffered by the devices
+func ParseTimestamp(tm []byte) (time.Time, error) {
+	if len(tm) < 14 {
+		return time.Time{}, errors.New("invalid timestamp: " + string(tm))
+	}
+
 	// year
 	len := 0
 	target := string(tm[:len+4]) + "-"
@@ -43,18 +62,9 @@ func GetTimestampFromString(tm []byte) time.Time {
 	target += string(tm[len:len+2]) + "+00:00"
 	len += 2
 
-	t, err := time.Parse(
+	return time.Parse(
 		time.RFC3339,
 		target)
-	if err != nil {
-		t = time.Now()
-		log.Error(err)
-	} else if math.Abs(float64(t.Unix()-time.Now().Unix())) > SECS_15MINUTE {
-		// TODO: THIS SHOULD BE TAKEN CARED BY THE APPLICATIONS OF GPS DATA, NOT THE ACCESS SERVER ITSELF
-		t = time.Now()
-	}
-
-	return t
 }
 
 func String2LogLevel(strL string) (log.Level, error) {
@@ -89,18 +99,40 @@ func DecodeTY905Byte(bcd byte) byte {
 	return t2*10 + t1
 }
 
+// the digits of the bcd bytes as a number, e.g: 01 80 -> 180
+func DecodeTY905Int(bcd []byte) int {
+	ret := 0
+	for _, v := range bcd {
+		ret = ret*100 + int(DecodeTY905Byte(v))
+	}
+	return ret
+}
+
+// YYMMDDhhmmss in bcd to the customed time format, e.g:
+// 15 06 12 19 30 50 -> 20150612193050
 func DecodeTY905Time(ts []byte) string {
 	if len(ts) != 6 {
 		return ""
-	} else {
-		for _, v := range ts {
-			v = v
-		}
 	}
-	return ""
+	return fmt.Sprintf("20%012d", DecodeTY905Int(ts))
 }
+
+// ddmm.mmmm in bcd to degrees, e.g: 22 32 80 99 -> 22.546832
 func DecodeTY905Lat(raw []byte) float32 {
-	return 0
+	if len(raw) != 4 {
+		return 0
+	}
+	v := DecodeTY905Int(raw)
+	return float32(v/1000000) + float32(v%1000000)/10000/60
+}
+
+// dddmm.mmm in bcd to degrees, e.g: 11 40 35 06 -> 114.058433
+func DecodeTY905Lon(raw []byte) float32 {
+	if len(raw) != 4 {
+		return 0
+	}
+	v := DecodeTY905Int(raw)
+	return float32(v/100000) + float32(v%100000)/1000/60
 }
 
 func EncodeCBCDByte(str string) byte {
@@ -0,0 +1,109 @@
+// Copyright 2015 ZheJiang QunShuo, Inc. All rights reserved
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// certificate, key and optional client CA files of a TLS listener.
+// they are reloaded on SIGHUP, only new handshakes see the new ones so
+// the established sessions are kept
+type CertStore struct {
+	CertFile, KeyFile, ClientCAFile string
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	lock      sync.RWMutex
+}
+
+var gCertStores []*CertStore
+var gCertStoresLock sync.Mutex
+
+// load the files, clientCAFile is optional and enables client certificate
+// verification
+func NewCertStore(certFile, keyFile, clientCAFile string) (*CertStore, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls certificate and key files are required")
+	}
+	ret := &CertStore{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+
+	gCertStoresLock.Lock()
+	gCertStores = append(gCertStores, ret)
+	gCertStoresLock.Unlock()
+	return ret, nil
+}
+
+// reload the files, the old ones are kept on error
+func (s *CertStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if s.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + s.ClientCAFile)
+		}
+	}
+
+	s.lock.Lock()
+	s.cert = &cert
+	s.clientCAs = pool
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cert, nil
+}
+
+// server side config, resolved per handshake to pick up reloaded files
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			cfg := &tls.Config{
+				Certificates: []tls.Certificate{*s.cert},
+				MinVersion:   tls.VersionTLS12,
+			}
+			if s.clientCAs != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = s.clientCAs
+			}
+			return cfg, nil
+		},
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+// reload all the cert stores, called on SIGHUP
+func ReloadCertStores() {
+	gCertStoresLock.Lock()
+	defer gCertStoresLock.Unlock()
+	for _, v := range gCertStores {
+		if err := v.Reload(); err != nil {
+			log.Error("failed to reload ", v.CertFile, ": ", err)
+		} else {
+			log.Info("reloaded ", v.CertFile)
+		}
+	}
+}
@@ -24,3 +24,15 @@ func TestEncodeCBCDFromString(t *testing.T) {
 		t.Error("expected", 0xF23A, "got", b)
 	}
 }
+
+func TestDecodeTY905(t *testing.T) {
+	if tm := DecodeTY905Time([]byte{0x15, 0x06, 0x12, 0x19, 0x30, 0x50}); tm != "20150612193050" {
+		t.Error("unexpected time:", tm)
+	}
+	if lat := DecodeTY905Lat([]byte{0x22, 0x32, 0x80, 0x99}); lat < 22.54683 || lat > 22.54684 {
+		t.Error("unexpected lat:", lat)
+	}
+	if lon := DecodeTY905Lon([]byte{0x11, 0x40, 0x35, 0x06}); lon < 114.05843 || lon > 114.05844 {
+		t.Error("unexpected lon:", lon)
+	}
+}
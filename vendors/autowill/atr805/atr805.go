@@ -18,10 +18,12 @@ import (
 )
 
 const (
+	VENDOR_NAME      = "atr805"
 	PROTO_IDENTIFIER = "\x92\x29"
 
 	PACKET_UP_GPS    = byte(0x80)
 	PACKET_UP_LBS    = byte(0x86)
+	PACKET_UP_ACK    = byte(0x85)
 	PACKET_DOWN_REP  = byte(0x21)
 	PACKET_DOWN_MODE = byte(0x7f)
 	PACKET_DOWN_ADDR = byte(0x79)
@@ -68,25 +70,43 @@ func (s *Atr805) IsValid() bool {
 }
 
 func (s *Atr805) IsWhole() int {
+	if len(s.buff) < 5 {
+		return -1
+	}
 	// multi-partial packets enhencement.
+	// the length counts the bytes following it, the tail 0x0d included
 	b := int(s.buff[3])<<8 + int(s.buff[4])
 	if len(s.buff[5:]) == b && s.buff[len(s.buff)-1] == '\x0d' {
 		return 0
-	} else if len(s.buff[5:]) > b && s.buff[b+5] == '\x0d' {
+	} else if len(s.buff[5:]) > b && b > 0 && s.buff[b+4] == '\x0d' {
 		return len(s.buff) - b - 5
 	}
 
-	log.Error("invalid length:", s.buff, "expected:", b, "actual:", len(s.buff[5:]), "last:", s.buff[len(s.buff)-1])
+	log.Debug("invalid length:", s.buff, "expected:", b, "actual:", len(s.buff[5:]), "last:", s.buff[len(s.buff)-1])
 	return -1
 }
 
+func (s *Atr805) DeviceKey() string {
+	if len(s.buff) < 11 {
+		return ""
+	}
+	return hex.EncodeToString(s.buff[5:11])
+}
+
 //
 func (s *Atr805) HandleMsg() bool {
 	log.Debug("handlemsg called")
 	// s.rawPacket.UdpConn.WriteToUDP(s.rawPacket.Buff, s.rawPacket.Remote)
 	s.imei = "ATR" + strings.ToUpper(hex.EncodeToString(s.buff[5:11]))
 
-	handleCmds(s)
+	// unknown devices are handled by the policy, nothing to store
+	if !handleCmds(s) {
+		return false
+	}
+	if s.buff[2] == PACKET_UP_ACK {
+		handleAck(s)
+		return false
+	}
 
 	if s.buff[2] == PACKET_UP_GPS {
 		lat := float64(utils.DecodeTY905Byte(s.buff[0xb])) + (float64(utils.DecodeTY905Byte(s.buff[0xc]))+
@@ -140,15 +160,44 @@ func (s *Atr805) HandleMsg() bool {
 
 func (s *Atr805) SaveToDB(dbHelper *dbh.DbHelper) error {
 	log.Debug("called save to db")
-	dbh.SaveToDB(s.imei, s.lat, s.lon, s.speed, s.heading, s.gpsTime, dbHelper)
-	return nil
+	return dbh.SaveToDB(s.imei, s.lat, s.lon, s.speed, s.heading, s.gpsTime, dbHelper)
 }
 
 // --- cmd related code
-type TCmdFunc func(*dbh.TCMD, *Atr805) bool
+// encode a command to the device, imei without the ATR prefix, 12 digits
+type TCmdFunc func(cmd dbh.TCMD, imei string) ([]byte, error)
 
+// SRVADDR is not supported, no layout of PACKET_DOWN_ADDR is known to be
+// taken by the devices
 var _cmdMap = map[string]TCmdFunc{
-	dbh.CMD_TYPE_REPINTV: handleCmdRepInterval,
+	dbh.CMD_TYPE_REPINTV:  handleCmdRepInterval,
+	dbh.CMD_TYPE_WORKMODE: handleCmdWorkMode,
+}
+
+// downlink packet of the commands, echoed by the acks
+var _cmdPackets = map[string]byte{
+	dbh.CMD_TYPE_REPINTV:  PACKET_DOWN_MODE,
+	dbh.CMD_TYPE_WORKMODE: PACKET_DOWN_MODE,
+}
+
+// payload of PACKET_DOWN_MODE, laid out as the REPINTV frame the deployed
+// devices take: 92 29 7f 00 1d <sn 6> <mask> <retry> <moving 4>
+// <stationary 4> ff 0d. the length is sent as deployed. the frame has no
+// mode byte, the continuous, timed and sleep modes can't be set
+type workMode struct {
+	mask, retry byte
+	// report intervals while moving and stationary, seconds
+	moving, stationary uint32
+}
+
+func (m *workMode) encode(imei string) []byte {
+	head := []byte("\x92\x29\x7F\x00\x1D")
+	sn := utils.EncodeCBCDFromString(imei)
+	payload := make([]byte, 10)
+	payload[0], payload[1] = m.mask, m.retry
+	binary.BigEndian.PutUint32(payload[2:], m.moving)
+	binary.BigEndian.PutUint32(payload[6:], m.stationary)
+	return bytes.Join([][]byte{head, sn, payload, []byte("\xff\x0d")}, nil)
 }
 
 //
@@ -162,75 +211,117 @@ func confirmMessage(atr *Atr805) bool {
 	return true
 }
 
-//
-func handleCmdRepInterval(cmd *dbh.TCMD, atr *Atr805) bool {
+// params: HHMM,interval, the interval both moving and stationary with the
+// mask 01 and retry 0a of the deployed frame
+func handleCmdRepInterval(cmd dbh.TCMD, imei string) ([]byte, error) {
 	params := strings.Split(cmd.Params, ",")
-	if len(params) == 2 && len(params[0]) == 4 && len(params[1]) > 0 {
-		head := []byte("\x92\x29\x7F\x00\x1D")
-		sn := utils.EncodeCBCDFromString(atr.imei[3:])
-		mask_retry := []byte("\x01\x0A")
-		interval := make([]byte, 4)
-		_interval, err := strconv.Atoi(params[1])
+	if len(params) != 2 || len(params[0]) != 4 || len(params[1]) == 0 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	interval, err := strconv.ParseUint(params[1], 10, 32)
+	if err != nil || interval == 0 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	m := &workMode{0x01, 0x0A, uint32(interval), uint32(interval)}
+	cmdBuff := m.encode(imei)
+	log.Debug("cmd buff: ", hex.EncodeToString(cmdBuff))
+	return cmdBuff, nil
+}
+
+// params: mask,retry,moving,stationary, like 1,10,30,600, the intervals in
+// seconds
+func handleCmdWorkMode(cmd dbh.TCMD, imei string) ([]byte, error) {
+	params := strings.Split(cmd.Params, ",")
+	if len(params) != 4 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	var v [4]uint64
+	for i, bits := range []int{8, 8, 32, 32} {
+		n, err := strconv.ParseUint(params[i], 10, bits)
 		if err != nil {
-			log.Error(err, cmd)
-			dbh.CommitCmdToDb(cmd, "INVALID")
-			return false
+			return nil, dbh.ErrInvalidCmd
 		}
-		binary.BigEndian.PutUint32(interval, uint32(_interval))
-		tail := []byte("\xff\x0d")
-		cmdBuff := bytes.Join([][]byte{head, sn, mask_retry, interval, interval, tail}, nil)
-		log.Info("applied cmd: ", hex.EncodeToString(cmdBuff))
-		(*atr.conn).Write(cmdBuff)
-		cmd.Status = dbh.CMD_STATUS_APPLIED
-		dbh.CommitCmdToDb(cmd, dbh.CMD_STATUS_APPLIED)
-		return true
+		v[i] = n
 	}
-	return false
+	if v[2] == 0 || v[3] == 0 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	m := &workMode{byte(v[0]), byte(v[1]), uint32(v[2]), uint32(v[3])}
+	cmdBuff := m.encode(imei)
+	log.Debug("cmd buff: ", hex.EncodeToString(cmdBuff))
+	return cmdBuff, nil
 }
 
 //
 func handleCmds(atr *Atr805) bool {
 	//
 	imei := atr.imei
-	id, err := dbh.GetIdByImei(imei)
+	id, err := dbh.LookupDevice(imei, VENDOR_NAME, *atr.conn)
 	if err != nil {
 		log.Error("device not existed: ", imei, err)
 		return false
 	}
 
-	cmds := dbh.GetCmds(id)
-	for _, v := range cmds {
-		if v == nil {
-			continue
-		}
-		if v.Status == dbh.CMD_STATUS_PENDING {
-			log.Debug("got cmd: ", v)
-			_cmd := dbh.GetCmdFromDb(id, v.Type)
-			if _cmd != nil {
-				if v.Id != _cmd.Id {
-					dbh.CommitCmdToDb(v, "OVERWRITE")
-				}
-				v.Params = _cmd.Params
-				v.Id = _cmd.Id
-			} else {
-				dbh.DeleteCmd(id, v.Type)
-				goto HANDLED_CMD
-			}
+	sess := dbh.Online(&dbh.Session{Imei: imei, DeviceId: id, Vendor: VENDOR_NAME,
+		Conn: *atr.conn, Sender: sendCmds, Acks: true})
+	sess.DeliverCmds()
 
-			if fn, ok := _cmdMap[_cmd.Type]; ok {
-				fn(_cmd, atr)
-			}
-		}
+	// the acks of the device are not confirmed
+	if atr.buff[2] == PACKET_UP_ACK {
+		return true
 	}
-
-HANDLED_CMD:
 	// TODO need device to test
 	confirmMessage(atr)
 	return true
 }
 
+// 0x85 ack, the downlink packet acked follows the sn, the rest is not
+// read: 92 29 85 <len 2> <sn 6> <packet> ... 0d
+func handleAck(atr *Atr805) {
+	id, err := dbh.GetIdByImei(atr.imei)
+	if err != nil {
+		log.Error("ack of unknown device: ", atr.imei, ", ", err)
+		return
+	}
+	packet := atr.buff[11]
+	dbh.AckCmd(id, func(cmd dbh.TCMD) bool {
+		p, ok := _cmdPackets[cmd.Type]
+		return ok && p == packet
+	})
+}
+
+// write the pending commands onto the session, also called by the session
+// registry once a new command is queued for the connected device
+func sendCmds(sess *dbh.Session) bool {
+	return dbh.SendCmds(sess, writeCmd)
+}
+
+func writeCmd(sess *dbh.Session, cmd dbh.TCMD) error {
+	fn, ok := _cmdMap[cmd.Type]
+	if !ok {
+		return dbh.ErrInvalidCmd
+	}
+	buff, err := fn(cmd, sess.Imei[3:])
+	if err != nil {
+		return err
+	}
+	_, err = sess.Write(buff)
+	return err
+}
+
+// checked before the command is queued
+func validateCmd(cmd dbh.TCMD) error {
+	fn, ok := _cmdMap[cmd.Type]
+	if !ok {
+		return dbh.ErrInvalidCmd
+	}
+	_, err := fn(cmd, "000000000000")
+	return err
+}
+
 func init() {
 	log.SetLevel(log.DebugLevel)
-	tcp2.Register(New())
+	tcp2.Register(VENDOR_NAME, New())
+	dbh.RegisterCmdValidator(VENDOR_NAME, validateCmd)
 	log.Debug("registered")
 }
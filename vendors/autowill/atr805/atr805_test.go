@@ -0,0 +1,54 @@
+package atr805
+
+import (
+	"encoding/hex"
+	dbh "lbsas/database"
+	"testing"
+)
+
+func TestCmdSrvAddr(t *testing.T) {
+	if err := validateCmd(dbh.TCMD{Type: dbh.CMD_TYPE_SRVADDR, Params: "202.96.128.166:9020"}); err != dbh.ErrInvalidCmd {
+		t.Error("expected SRVADDR unsupported:", err)
+	}
+}
+
+func TestCmdRepInterval(t *testing.T) {
+	buff, err := handleCmdRepInterval(dbh.TCMD{Type: dbh.CMD_TYPE_REPINTV, Params: "0400,60"}, "135790246811")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frame of the deployed devices
+	if s := hex.EncodeToString(buff); s != "92297f001d135790246811"+"010a"+"0000003c"+"0000003c"+"ff0d" {
+		t.Error("unexpected frame:", s)
+	}
+	for _, v := range []string{"", "0400", "0400,0", "0400,x"} {
+		if err := validateCmd(dbh.TCMD{Type: dbh.CMD_TYPE_REPINTV, Params: v}); err == nil {
+			t.Error("expected invalid:", v)
+		}
+	}
+}
+
+func TestCmdWorkMode(t *testing.T) {
+	cases := []struct {
+		params, want string
+	}{
+		// the same as the deployed REPINTV frame
+		{"1,10,60,60", "92297f001d135790246811" + "010a" + "0000003c" + "0000003c" + "ff0d"},
+		{"3,5,30,600", "92297f001d135790246811" + "0305" + "0000001e" + "00000258" + "ff0d"},
+	}
+	for _, v := range cases {
+		buff, err := handleCmdWorkMode(dbh.TCMD{Type: dbh.CMD_TYPE_WORKMODE, Params: v.params}, "135790246811")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := hex.EncodeToString(buff); s != v.want {
+			t.Error("unexpected frame:", s, "for", v.params)
+		}
+	}
+	for _, v := range []string{"", "continuous,1,10,30,600", "1,10,0,600", "256,10,30,600", "1,10,30",
+		"1,10,30,-1", "1,10,30,4294967296"} {
+		if err := validateCmd(dbh.TCMD{Type: dbh.CMD_TYPE_WORKMODE, Params: v}); err == nil {
+			t.Error("expected invalid:", v)
+		}
+	}
+}
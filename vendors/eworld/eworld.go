@@ -21,10 +21,10 @@ import (
 )
 
 const (
-	CMD_STATUS_OVERWRITE = "OVERWRITE"
-	CMD_STATUS_APPLIED   = "APPLIED"
-	CMD_STATUS_PENDING   = "PENDING"
-	CMD_TYPE_REPINTV     = "REPINTV"
+	VENDOR_NAME = "eworld"
+
+	// reply of the device to a command
+	MSG_ACK = "V4"
 )
 
 // module exported global variables
@@ -46,6 +46,12 @@ var _MessageConstants = &struct {
 	byte(','),
 }
 
+// code of the supported commands, echoed by the V4 replies
+var _CmdCodes = map[string]string{
+	dbh.CMD_TYPE_REPINTV: "I2",
+	dbh.CMD_TYPE_SRVADDR: "S23",
+}
+
 // Allocate a new vendor proto. instance
 func New(env *EnviromentCfg) *EWorld {
 	log.SetLevel(env.LogLevel)
@@ -60,6 +66,7 @@ func New(env *EnviromentCfg) *EWorld {
 
 	return &EWorld{
 		NetConfig{ // flags
+			Vendor:         VENDOR_NAME,
 			Addr:           env.TCPAddr,
 			HttpAddr:       env.HTTPAddr,
 			Protocol:       "tcp",
@@ -71,45 +78,47 @@ func New(env *EnviromentCfg) *EWorld {
 			EndSymbol:      '#',
 			LogLevel:       env.LogLevel,
 			DBAddr:         env.DBAddr,
+			TLSConfig:      env.TLSConfig,
+			QueuePolicy:    env.QueuePolicy,
+			SpillDir:       env.SpillDir,
+			SpillMaxMB:     env.SpillMaxMB,
 		},
 		dbHelper, VendorStat{},
 	}
 }
 
-// packet consumer
-func (s *EWorld) TcpWorker(packetsChan chan *RawTcpPacket) {
+// packet consumer, called by the workers of the listener pool
+func (s *EWorld) HandlePacket(packet *RawTcpPacket) bool {
 	// all time related calculations can be safely ignored when review
-	isFirstTime := true
-	for {
-		timeLast := time.Now()
-
-		// get a packet from the pipe
-		packet := <-packetsChan
-
-		success := false
-		// handle channel close event
-		if packet == nil {
-			log.Debug("nil packet, close connection")
-			break
-		} else {
-			// data packet
-			if success = s.handlePacket(packet); !success {
-				s.Stat.NumInvalidPackets++
-				continue
-			}
-		}
-		// micro sec
-		var delta uint64 = uint64((time.Now().UnixNano() - timeLast.UnixNano()) / 1000)
-		if isFirstTime {
-			isFirstTime = false
-		} else {
-			if s.Stat.AvgWorkerTimeMicroSec == 0 {
-				s.Stat.AvgWorkerTimeMicroSec = delta
-			} else {
-				s.Stat.AvgWorkerTimeMicroSec = (s.Stat.AvgWorkerTimeMicroSec + delta) / 2
-			}
-		}
+	timeLast := time.Now()
+
+	// data packet
+	if !s.handlePacket(packet) {
+		s.Stat.NumInvalidPackets++
+		return false
 	}
+
+	// micro sec
+	var delta uint64 = uint64((time.Now().UnixNano() - timeLast.UnixNano()) / 1000)
+	if s.Stat.AvgWorkerTimeMicroSec == 0 {
+		s.Stat.AvgWorkerTimeMicroSec = delta
+	} else {
+		s.Stat.AvgWorkerTimeMicroSec = (s.Stat.AvgWorkerTimeMicroSec + delta) / 2
+	}
+	return true
+}
+
+// device identity of a packet, *HQ,8150708207,V1,...
+func (s *EWorld) DeviceKey(buff []byte) string {
+	return deviceKey(buff)
+}
+
+func deviceKey(buff []byte) string {
+	parts := bytes.SplitN(buff, []byte{_MessageConstants.Delimiter}, 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return string(parts[1])
 }
 
 // helper function
@@ -131,9 +140,13 @@ func (s *EWorld) GetCfg() *NetConfig {
 	return &(s.TcpConfig)
 }
 
+func (s *EWorld) GetStat() *VendorStat {
+	return &(s.Stat)
+}
+
+// the database helper is shared by all the listeners, leave it open
 func (s *EWorld) Close() {
-	s.Close()
-	close(s.DBMsgChan)
+	log.Info("listener closed: ", s.TcpConfig.Vendor, "@", s.TcpConfig.Addr)
 }
 
 func (s *EWorld) SetLogLevel(lvl log.Level) {
@@ -173,101 +186,149 @@ func (s *EWorld) handlePacket(packet *RawTcpPacket) bool {
 }
 
 // reply messages
-func (s *EWorld) handleCmds(sn string, conn *net.Conn) bool {
+func handleCmds(sn string, conn *net.Conn) bool {
 	//
 	imei := "WORLD" + sn
-	id, err := dbh.GetIdByImei(imei)
+	id, err := dbh.LookupDevice(imei, VENDOR_NAME, *conn)
 	if err != nil {
 		log.Error("device not existed: ", imei, err)
 		return false
 	}
 
-	sentCmd := false
-	cmdError := false
-	// *TH,2020916012,I1,050400,0,0,14,XRDDCS12001440#
-	cmd := dbh.GetCmd(id, CMD_TYPE_REPINTV)
-	//log.Debug("query for cmd: ", id, ":", CMD_TYPE_REPINTV)
-	if cmd != nil && cmd.Status == CMD_STATUS_PENDING {
-		log.Debug("got cmd: ", cmd)
-		_cmd := dbh.GetCmdFromDb(id, CMD_TYPE_REPINTV)
-		if _cmd != nil {
-			if cmd.Id != _cmd.Id {
-				dbh.CommitCmdToDb(cmd, "OVERWRITE")
-			}
-
-			cmd.Params = _cmd.Params
-			cmd.Id = _cmd.Id
-		} else {
-			dbh.DeleteCmd(id, CMD_TYPE_REPINTV)
-			goto HANDLED_CMD
-		}
-
-		params := strings.Split(cmd.Params, ",")
-		if len(params) == 2 && len(params[0]) == 4 && len(params[1]) > 0 {
-			h, err := strconv.ParseInt(params[0][0:2], 10, 16)
-			if err != nil || h < 0 || h > 24 {
-				cmdError = true
-				goto HANDLED_CMD
-			}
-			// UTC to UTC+8
-			h = (h + 8) % 24
-			m, err := strconv.ParseInt(params[0][2:4], 10, 16)
-			if err != nil || m < 0 || m > 59 {
-				cmdError = true
-				goto HANDLED_CMD
-			}
-
-			interval, err := strconv.ParseInt(params[1], 10, 16)
-			if err != nil || interval < 0 || interval > 1440 {
-				cmdError = true
-				goto HANDLED_CMD
-			}
-			cfg := fmt.Sprintf("%02d%02d", h, m) + fmt.Sprintf("%04d", interval)
-			ackFormat := "*TH,%s,I2,050400,0,0,14,XRDDCS%s#"
-			theCmd := []byte(fmt.Sprintf(ackFormat, imei[5:], cfg))
-			log.Info("applied cmd: ", theCmd)
-			(*conn).Write(theCmd)
-			sentCmd = true
-			cmd.Status = CMD_STATUS_APPLIED
-			log.Debug("cmd sent: ", cmd)
-			dbh.CommitCmdToDb(cmd, CMD_STATUS_APPLIED)
-		}
-	}
-
-HANDLED_CMD:
-	if cmdError {
-		log.Error("invalid cmd:", cmd)
-		dbh.CommitCmdToDb(cmd, "INVALID")
-	}
+	sess := dbh.Online(&dbh.Session{Imei: imei, DeviceId: id, Vendor: VENDOR_NAME,
+		Conn: *conn, Sender: sendCmds, Acks: true})
 
-	if !sentCmd {
+	if !sess.DeliverCmds() {
 		// reply the message
 		// *TH,2020916012,I1,050400,0,0,6,XRDDCP#
 		ackFormat := "*TH,%s,I1,%s,0,0,6,XRDDCP#"
 		tm := time.Now()
 		hhmmss := fmt.Sprintf("%02d%02d%02d", tm.Hour(), tm.Minute(), tm.Second())
-		(*conn).Write([]byte(fmt.Sprintf(ackFormat, imei[5:], hhmmss)))
+		sess.Write([]byte(fmt.Sprintf(ackFormat, imei[5:], hhmmss)))
 	}
 
 	return true
 }
 
+// write the pending commands onto the session, also called by the session
+// registry once a new command is queued for the connected device
+func sendCmds(sess *dbh.Session) bool {
+	return dbh.SendCmds(sess, writeCmd)
+}
+
+func writeCmd(sess *dbh.Session, cmd dbh.TCMD) error {
+	buff, err := encodeCmd(sess.Imei[5:], cmd)
+	if err != nil {
+		return err
+	}
+	_, err = sess.Write(buff)
+	return err
+}
+
+// checked before the command is queued
+func validateCmd(cmd dbh.TCMD) error {
+	_, err := encodeCmd("", cmd)
+	return err
+}
+
+func encodeCmd(sn string, cmd dbh.TCMD) ([]byte, error) {
+	switch cmd.Type {
+	case dbh.CMD_TYPE_REPINTV:
+		return encodeRepInterval(sn, cmd)
+	case dbh.CMD_TYPE_SRVADDR:
+		return encodeSrvAddr(sn, cmd, time.Now())
+	}
+	return nil, dbh.ErrInvalidCmd
+}
+
+// params: ip:port, *TH,2020916012,S23,130305,202.96.128.166,9020#. the
+// downlinks take the *TH header like the other commands
+func encodeSrvAddr(sn string, cmd dbh.TCMD, tm time.Time) ([]byte, error) {
+	ip, port, err := dbh.ParseSrvAddr(cmd.Params)
+	if err != nil {
+		return nil, err
+	}
+	hhmmss := fmt.Sprintf("%02d%02d%02d", tm.Hour(), tm.Minute(), tm.Second())
+	return []byte(fmt.Sprintf("*TH,%s,%s,%s,%s,%d#", sn, _CmdCodes[cmd.Type], hhmmss, ip, port)), nil
+}
+
+// params: HHMM,interval, the start time in UTC and the interval in minutes
+func encodeRepInterval(sn string, cmd dbh.TCMD) ([]byte, error) {
+	// *TH,2020916012,I1,050400,0,0,14,XRDDCS12001440#
+	params := strings.Split(cmd.Params, ",")
+	if len(params) != 2 || len(params[0]) != 4 || len(params[1]) == 0 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	h, err := strconv.ParseInt(params[0][0:2], 10, 16)
+	if err != nil || h < 0 || h > 24 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	// UTC to UTC+8
+	h = (h + 8) % 24
+	m, err := strconv.ParseInt(params[0][2:4], 10, 16)
+	if err != nil || m < 0 || m > 59 {
+		return nil, dbh.ErrInvalidCmd
+	}
+	interval, err := strconv.ParseInt(params[1], 10, 16)
+	if err != nil || interval < 0 || interval > 1440 {
+		return nil, dbh.ErrInvalidCmd
+	}
+
+	cfg := fmt.Sprintf("%02d%02d", h, m) + fmt.Sprintf("%04d", interval)
+	ackFormat := "*TH,%s,%s,050400,0,0,14,XRDDCS%s#"
+	return []byte(fmt.Sprintf(ackFormat, sn, _CmdCodes[cmd.Type], cfg)), nil
+}
+
+// *HQ,8150708207,V4,I2,...#, the reply to the oldest sent command of the code
+func handleAck(parts []string, conn *net.Conn) {
+	if len(parts) < 4 {
+		log.Error("invalid ack: ", parts, ", From:", (*conn).RemoteAddr())
+		return
+	}
+	imei := "WORLD" + parts[1]
+	id, err := dbh.GetIdByImei(imei)
+	if err != nil {
+		log.Error("ack of unknown device: ", imei, ", ", err)
+		return
+	}
+	dbh.AckCmd(id, func(cmd dbh.TCMD) bool {
+		return _CmdCodes[cmd.Type] == parts[3]
+	})
+}
+
 // parse one message in a packet
 func (s *EWorld) parseMessage(parts []string, conn *net.Conn) interface{} {
+	dbmsg := decodeMessage(parts, conn)
+	if dbmsg != nil {
+		// put the message onto the database pipe, assured!!
+		if !s.Put(parts[1], dbmsg) {
+			s.Stat.DBWriteMsgDropped++
+		}
+	}
+
+	return nil
+}
+
+// decode one message, shared by the tcp vendor and the tcp2 proto.
+// returns the message to be stored, nil if invalid
+func decodeMessage(parts []string, conn *net.Conn) dbh.IDBMessage {
 	var err error = nil
 	var lat, lng float64
 	if len(parts) < 3 || len(parts[2]) < 1 || len(parts[1]) < 1 {
 		return nil
 	}
 
-	if par := _MessageConstants.Commands[parts[2][0:1]]; par != nil {
-		var dbmsg dbh.IDBMessage
+	if parts[2] == MSG_ACK {
+		handleAck(parts, conn)
+		return nil
+	}
 
+	var dbmsg dbh.IDBMessage
+	if par := _MessageConstants.Commands[parts[2][0:1]]; par != nil {
 		switch par.(type) {
 		case GenRespMsg:
 			_par := GenRespMsg{}
-			if _par.Parse(parts, conn) {
-				s.handleCmds(parts[1], conn)
+			if _par.Parse(parts, conn) && handleCmds(parts[1], conn) {
 				// convert WGS to GCJ-02
 				if len(_par.Latitude) == 0 {
 					_par.Latitude = []byte("0")
@@ -320,37 +381,20 @@ func (s *EWorld) parseMessage(parts []string, conn *net.Conn) interface{} {
 				lat, lng = gcj02.WGStoBD(lat, lng)
 				_par.Latitude = []byte(strconv.FormatFloat(lat, 'f', 6, 64))
 				_par.Longitude = []byte(strconv.FormatFloat(lng, 'f', 6, 64))
+				dbmsg = newStatusMsg("WORLD"+parts[1], string(_par.Status), &_par)
 			}
-			dbmsg = &_par
 		case LbsRespMsg:
 			_par := LbsRespMsg{}
-			if _par.Parse(parts, conn) {
-				s.handleCmds(parts[1], conn)
+			if _par.Parse(parts, conn) && handleCmds(parts[1], conn) {
+				dbmsg = newStatusMsg("WORLD"+parts[1], string(_par.Status), &_par)
 			}
-			dbmsg = &_par
 
 		default:
 			log.Error("unkown message", parts, "From", (*conn).RemoteAddr().String())
 		}
-
-		if err == nil {
-			// put the message onto the database pipe, assured!!
-			// the for-select-break style is my innovation? :)
-			for {
-				select {
-				case s.DBMsgChan <- dbmsg:
-					goto BREAK_
-				default:
-					// database pipe overflow, pop the oldest one and insert the new one
-					<-s.DBMsgChan
-					s.Stat.DBWriteMsgDropped++
-				}
-			}
-		BREAK_:
-		}
 	} else {
 		log.Error("unkown cmd", parts, "From", (*conn).RemoteAddr().String())
 	}
 
-	return nil
+	return dbmsg
 }
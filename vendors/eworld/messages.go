@@ -76,11 +76,16 @@ func (m *GenRespMsg) Parse(parts []string, conn *net.Conn) bool {
 	return true
 }
 
-func (s *GenRespMsg) SaveToDB(dbhelper *dbh.DbHelper) error {
+func (s *GenRespMsg) position() *dbh.Position {
 	mTime := bytes.Join([][]byte{s.Date[4:6], s.Date[2:4], s.Date[0:2], s.Time}, nil)
 	ts := utils.GetTimestampFromString(mTime).UnixNano() / 1000000
-	return dbh.SaveToDB("WORLD"+string(s.SN), string(s.Latitude),
-		string(s.Longitude), string(s.Speed), string(s.Azimuth), ts, dbhelper)
+	return &dbh.Position{Imei: "WORLD" + string(s.SN), Lat: string(s.Latitude),
+		Lon: string(s.Longitude), Speed: string(s.Speed), Heading: string(s.Azimuth), Ts: ts,
+		Voltage: powerVoltage(s.Power)}
+}
+
+func (s *GenRespMsg) SaveToDB(dbhelper *dbh.DbHelper) error {
+	return dbh.SaveEvent(s.position(), dbhelper)
 }
 
 //
@@ -138,12 +143,17 @@ func (m *LbsRespMsg) Parse(parts []string, conn *net.Conn) bool {
 	return true
 }
 
-func (s *LbsRespMsg) SaveToDB(dbhelper *dbh.DbHelper) error {
+func (s *LbsRespMsg) position() *dbh.Position {
 	lat, lon := dbh.GetCellLocationBD(string(s.MCC), string(s.MNC), string(s.LAC), string(s.CELL))
 	// get the time
 	log.Debug("LBS lat:", lat, ",lon:", lon)
 	ts := time.Now().UnixNano() / 1000000
-	return dbh.SaveToDB("WORLD"+string(s.SN), lat, lon, "0", "0", ts, dbhelper)
+	return &dbh.Position{Imei: "WORLD" + string(s.SN), Lat: lat, Lon: lon, Speed: "0", Heading: "0", Ts: ts,
+		Voltage: powerVoltage(s.Power)}
+}
+
+func (s *LbsRespMsg) SaveToDB(dbhelper *dbh.DbHelper) error {
+	return dbh.SaveEvent(s.position(), dbhelper)
 }
 
 func (m *LbsRespMsg) LogContent() {
@@ -0,0 +1,115 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package eworld
+
+import (
+	"bytes"
+	dbh "lbsas/database"
+	"lbsas/tcp2"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	START_SYMBOL = byte('*')
+	END_SYMBOL   = byte('#')
+
+	// *HQ,
+	MINIMUM_LEN = 4
+)
+
+// H02 text protocol on the tcp2 framework, one message per instance:
+// *HQ,8150708207,V1,083639,A,2235.5492,N,11358.6842,E,0.00,125,140715,DFFFFFFF#,BT3735#
+type H02 struct {
+	buff  []byte
+	conn  *net.Conn
+	dbmsg dbh.IDBMessage
+}
+
+func NewProto() dbh.IGPSProto {
+	return &H02{}
+}
+
+func (s *H02) New(args ...interface{}) dbh.IGPSProto {
+	if len(args) == 2 {
+		if buff, ok := args[0].([]byte); ok {
+			if conn, ok := args[1].(*net.Conn); ok {
+				return &H02{buff: buff, conn: conn}
+			}
+		}
+	}
+	return nil
+}
+
+// *XX, where XX is the vendor code
+func (s *H02) IsValid() bool {
+	if len(s.buff) < MINIMUM_LEN || s.buff[0] != START_SYMBOL {
+		return false
+	}
+	i := bytes.IndexByte(s.buff, _MessageConstants.Delimiter)
+	if i < 2 {
+		return false
+	}
+	for _, v := range s.buff[1:i] {
+		if v < 'A' || v > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// a message ends at a '#' not followed by the power field, e.g: "#,BT3735#".
+// the trailing CR/LF is part of the message
+func (s *H02) IsWhole() int {
+	num := 0
+	for i := 0; i < len(s.buff); i++ {
+		if s.buff[i] != END_SYMBOL {
+			continue
+		}
+		num++
+		end := i + 1
+		if end == len(s.buff) {
+			// the power field may still be on the way
+			if num%2 == 0 {
+				return 0
+			}
+			return -1
+		}
+		if s.buff[end] == _MessageConstants.Delimiter || s.buff[end] == ' ' {
+			continue
+		}
+		for end < len(s.buff) && (s.buff[end] == '\r' || s.buff[end] == '\n') {
+			end++
+		}
+		return len(s.buff) - end
+	}
+	return -1
+}
+
+func (s *H02) DeviceKey() string {
+	return deviceKey(s.buff)
+}
+
+// true to store in DB, false otherwise
+func (s *H02) HandleMsg() bool {
+	buff := bytes.TrimRight(s.buff, "\r\n")
+	if len(buff) < 2 || buff[0] != START_SYMBOL || buff[len(buff)-1] != END_SYMBOL {
+		log.Error("Invalid packet. Buff:", string(s.buff), ", From:", (*s.conn).RemoteAddr())
+		return false
+	}
+
+	parts := strings.Split(string(buff[1:len(buff)-1]), string(_MessageConstants.Delimiter))
+	s.dbmsg = decodeMessage(parts, s.conn)
+	return s.dbmsg != nil
+}
+
+func (s *H02) SaveToDB(dbHelper *dbh.DbHelper) error {
+	return s.dbmsg.SaveToDB(dbHelper)
+}
+
+func init() {
+	tcp2.Register(VENDOR_NAME, NewProto())
+	dbh.RegisterCmdValidator(VENDOR_NAME, validateCmd)
+}
@@ -0,0 +1,98 @@
+package eworld
+
+import (
+	dbh "lbsas/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestH02IsWhole(t *testing.T) {
+	gps := "*HQ,8150708207,V1,083639,A,2235.5492,N,11358.6842,E,0.00,125,140715,DFFFFFFF#,BT3735#"
+	lbs := "*HQ,8150523188,LBS,460,0,22716,28371,060180,DFFFFFFF#,BT3714#"
+	cases := []struct {
+		buff  string
+		valid bool
+		whole int
+	}{
+		{gps, true, 0},
+		{gps + "\r\n", true, 0},
+		{gps + lbs, true, len(lbs)},
+		{gps[:40], true, -1},
+		{gps[:len(gps)-8], true, -1},
+		{"+RESP:GTCTN,", false, -1},
+		{"*hq,", false, -1},
+	}
+	for _, v := range cases {
+		p := &H02{buff: []byte(v.buff)}
+		if p.IsValid() != v.valid {
+			t.Error("valid expected", v.valid, "for", v.buff)
+		}
+		if whole := p.IsWhole(); whole != v.whole {
+			t.Error("expected", v.whole, "got", whole, "for", v.buff)
+		}
+	}
+}
+
+func TestEncodeCmd(t *testing.T) {
+	cases := []struct {
+		cmd  dbh.TCMD
+		want string
+	}{
+		{dbh.TCMD{Type: dbh.CMD_TYPE_REPINTV, Params: "0400,60"}, "*TH,2020916012,I2,050400,0,0,14,XRDDCS12000060#"},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_REPINTV, Params: "0400"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_SRVADDR, Params: "202.96.128.166:9020"}, "*TH,2020916012,S23,"},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_SRVADDR, Params: "202.96.128.166"}, ""},
+		{dbh.TCMD{Type: "UNKNOWN"}, ""},
+	}
+	for _, v := range cases {
+		buff, err := encodeCmd("2020916012", v.cmd)
+		if v.want == "" {
+			if err != dbh.ErrInvalidCmd {
+				t.Error("expected invalid:", v.cmd, string(buff))
+			}
+		} else if err != nil || !strings.HasPrefix(string(buff), v.want) {
+			t.Error("unexpected", string(buff), err, "for", v.cmd)
+		}
+	}
+	tm := time.Date(2015, 6, 12, 13, 3, 5, 0, time.Local)
+	buff, _ := encodeSrvAddr("2020916012", cases[2].cmd, tm)
+	if string(buff) != "*TH,2020916012,S23,130305,202.96.128.166,9020#" {
+		t.Error("unexpected", string(buff))
+	}
+}
+
+func TestH02Status(t *testing.T) {
+	if f := statusFlags(0xDFFFFFFF); f != "acc" {
+		t.Error("unexpected flags:", f)
+	}
+	// sos and the door open
+	if f := statusFlags(0xFFFFFEFD); f != "sos,door,acc" {
+		t.Error("unexpected flags:", f)
+	}
+	cases := []struct {
+		status string
+		events string
+	}{
+		// the states of the first status raise no event
+		{"FFFFFBFF#", ""},
+		{"FFFFFFFD", "SOS,ACC_ON"},
+		{"FFFFFFFD", ""},
+		{"FFF7FBFF", "ACC_OFF,POWERCUT"},
+		{"XYZ", ""},
+	}
+	for _, v := range cases {
+		m := newStatusMsg("WORLDtest", v.status, &GenRespMsg{}).(*statusMsg)
+		if strings.Join(m.events, ",") != v.events {
+			t.Error("unexpected events of", v.status, ":", m.events)
+		}
+	}
+}
+
+func TestPowerVoltage(t *testing.T) {
+	for power, v := range map[string]string{"BT3714": "3.714", "BT3714#": "3.714", "": "", "3714": "", "BTxx": ""} {
+		if s := powerVoltage([]byte(power)); s != v {
+			t.Error("unexpected voltage of", power, ":", s)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package eworld
+
+import (
+	dbh "lbsas/database"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// a bit of the H02 status word, 8 hex digits with bit 0 the lowest bit of
+// the last byte, e.g. DFFFFFFF#. the bits are active low but acc
+type statusBit struct {
+	bit        uint
+	name       string
+	activeHigh bool
+	// the alarms raise an event once asserted, the states once changed
+	alarm bool
+}
+
+var _StatusBits = []statusBit{
+	{0, "vibration", false, true},
+	{1, "sos", false, true},
+	{2, "overspeed", false, true},
+	{8, "door", false, false},
+	{10, "acc", true, false},
+	{16, "lowbattery", false, true},
+	{19, "powercut", false, true},
+}
+
+func (b *statusBit) set(status uint32) bool {
+	high := (status>>b.bit)&1 == 1
+	return high == b.activeHigh
+}
+
+// the status word of each device, to tell the transitions
+type statusCache struct {
+	lock sync.Mutex
+	m    map[string]uint32
+}
+
+var _Statuses = &statusCache{m: make(map[string]uint32)}
+
+// the previous status of the device, replaced by the new one
+func (c *statusCache) swap(imei string, status uint32) (uint32, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old, ok := c.m[imei]
+	c.m[imei] = status
+	return old, ok
+}
+
+// names of the flags set, separated by ','
+func statusFlags(status uint32) string {
+	ret := make([]string, 0, len(_StatusBits))
+	for _, b := range _StatusBits {
+		if b.set(status) {
+			ret = append(ret, b.name)
+		}
+	}
+	return strings.Join(ret, ",")
+}
+
+// the events raised since the previous status: SOS once asserted, ACC_ON
+// and ACC_OFF once changed. the alarms set in the first status seen are
+// raised, the states are not
+func statusEvents(status, old uint32, known bool) []string {
+	ret := make([]string, 0)
+	for _, b := range _StatusBits {
+		now, was := b.set(status), known && b.set(old)
+		switch {
+		case b.alarm && now && !was:
+			ret = append(ret, strings.ToUpper(b.name))
+		case !b.alarm && known && now != was:
+			if now {
+				ret = append(ret, strings.ToUpper(b.name)+"_ON")
+			} else {
+				ret = append(ret, strings.ToUpper(b.name)+"_OFF")
+			}
+		}
+	}
+	return ret
+}
+
+// the battery voltage of the power field, BT3735 -> 3.735 V, empty if
+// the field is missing or of another form
+func powerVoltage(power []byte) string {
+	s := strings.TrimSuffix(string(power), "#")
+	if !strings.HasPrefix(s, "BT") {
+		return ""
+	}
+	mv, err := strconv.Atoi(s[2:])
+	if err != nil || mv <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(mv)/1000, 'f', 3, 64)
+}
+
+// a report of the device
+type positioner interface {
+	position() *dbh.Position
+}
+
+// a report with its status decoded, stored with the flags and one more
+// record per event raised
+type statusMsg struct {
+	msg    positioner
+	status string
+	flags  string
+	events []string
+}
+
+// the transitions are told in the order of the reports of the device,
+// before the reports are shared by the db writers
+func newStatusMsg(imei, status string, msg positioner) dbh.IDBMessage {
+	// followed by the power field, "DFFFFFFF#,BT3735"
+	status = strings.TrimSuffix(status, "#")
+	ret := &statusMsg{msg: msg, status: status}
+	v, err := strconv.ParseUint(status, 16, 32)
+	if err != nil || len(status) != 8 {
+		log.Error("invalid status of ", imei, ": ", status)
+		return ret
+	}
+	old, known := _Statuses.swap(imei, uint32(v))
+	ret.flags = statusFlags(uint32(v))
+	ret.events = statusEvents(uint32(v), old, known)
+	if len(ret.events) > 0 {
+		log.Info("events of ", imei, ": ", ret.events, ", status: ", status)
+	}
+	return ret
+}
+
+func (m *statusMsg) SaveToDB(dbhelper *dbh.DbHelper) error {
+	p := m.msg.position()
+	p.Flags = m.flags
+	if err := dbh.SaveEvent(p, dbhelper); err != nil {
+		return err
+	}
+	for _, v := range m.events {
+		ev := *p
+		ev.Event, ev.Data = v, "status="+m.status
+		if err := dbh.SaveEvent(&ev, dbhelper); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package nbsihai
+
+import (
+	dbh "lbsas/database"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// the factory password, used until a GTGBC with a new one is acked
+const DEFAULT_PASSWORD = "gl500"
+
+// a field of an AT+GT command, empty keeps the current setting of the
+// device. nil check for the reserved fields, always empty
+type atField struct {
+	name  string
+	check func(v string) bool
+}
+
+// AT+GTxxx=password,fields...,serial$
+type atCmd struct {
+	name   string
+	fields []atField
+}
+
+// the trailing fields may be left out of the params
+func (c *atCmd) encode(password string, params []string, serial string) ([]byte, error) {
+	if len(params) > len(c.fields) {
+		return nil, dbh.ErrInvalidCmd
+	}
+	fields := make([]string, len(c.fields))
+	for i, v := range params {
+		if v == "" {
+			continue
+		}
+		f := c.fields[i]
+		if f.check == nil || !f.check(v) {
+			log.Error("invalid ", c.name, " ", f.name, ": ", v)
+			return nil, dbh.ErrInvalidCmd
+		}
+		fields[i] = v
+	}
+	return []byte("AT+" + c.name + "=" + password + "," + strings.Join(fields, ",") + "," + serial + "$"), nil
+}
+
+func reserved(n int) []atField {
+	return make([]atField, n)
+}
+
+func matches(pattern string) func(string) bool {
+	re := regexp.MustCompile("^(" + pattern + ")$")
+	return re.MatchString
+}
+
+func intRange(min, max int64) func(string) bool {
+	return func(v string) bool {
+		n, err := strconv.ParseInt(v, 10, 64)
+		return err == nil && n >= min && n <= max
+	}
+}
+
+// 0 to disable, or min..max
+func offOrRange(min, max int64) func(string) bool {
+	return func(v string) bool {
+		return v == "0" || intRange(min, max)(v)
+	}
+}
+
+func floatRange(min, max float64) func(string) bool {
+	return func(v string) bool {
+		f, err := strconv.ParseFloat(v, 64)
+		return err == nil && f >= min && f <= max
+	}
+}
+
+var (
+	checkPassword = matches("[0-9a-zA-Z]{4,6}")
+	checkText     = matches("[0-9a-zA-Z._@-]{1,40}")
+	checkBool     = intRange(0, 1)
+	checkPort     = intRange(0, 65535)
+)
+
+// GTCTN is the continuous report, configured by GTGBC. GL500 has no GTFRI,
+// the fixed report of the vehicle trackers, both are encoded as GTGBC
+var _AtCmds = map[string]*atCmd{
+	// apn, apn user name, apn password
+	dbh.CMD_TYPE_GTBSI: {"GTBSI", append([]atField{
+		{"apn", checkText},
+		{"apn user name", matches("[0-9a-zA-Z._@-]{1,30}")},
+		{"apn password", matches("[0-9a-zA-Z._@-]{1,30}")},
+	}, reserved(4)...)},
+	// report mode, reserved, buffer enable, main server, main port, backup
+	// server, backup port, sms gateway, heartbeat interval, sack enable
+	dbh.CMD_TYPE_GTSRI: {"GTSRI", append([]atField{
+		{"report mode", intRange(0, 5)},
+		{"reserved", nil},
+		{"buffer enable", checkBool},
+		{"main server", matches("[0-9a-zA-Z.-]{1,60}")},
+		{"main port", checkPort},
+		{"backup server", matches("[0-9.]{7,15}")},
+		{"backup port", checkPort},
+		{"sms gateway", matches(`\+?[0-9]{1,20}`)},
+		{"heartbeat interval", offOrRange(5, 360)},
+		{"sack enable", checkBool},
+	}, reserved(4)...)},
+	// sign, hour offset, minute offset, daylight saving, UTC time
+	dbh.CMD_TYPE_GTTMA: {"GTTMA", append([]atField{
+		{"sign", matches(`[+-]`)},
+		{"hour offset", intRange(0, 23)},
+		{"minute offset", intRange(0, 59)},
+		{"daylight saving", checkBool},
+		{"UTC time", matches("[0-9]{14}")},
+	}, reserved(4)...)},
+	// mobile number, device name, new password, confirmed new password,
+	// event mask, 2 reserved, week report, time of day, wakeup interval,
+	// report frequency, continuous mode, continuous send interval, battery
+	// low percentage, sensor enable, gsm report, report destination,
+	// temperature report mode, temperature range, agps mode
+	dbh.CMD_TYPE_GTGBC: {"GTGBC", append([]atField{
+		{"mobile number", matches(`\+?[0-9]{1,20}`)},
+		{"device name", matches("[0-9a-zA-Z_-]{1,10}")},
+		{"new password", checkPassword},
+		{"confirmed new password", checkPassword},
+		{"event mask", matches("[0-9a-fA-F]{1,4}")},
+		{"reserved", nil},
+		{"reserved", nil},
+		{"week report", matches("[01]{14}")},
+		{"time of day", matches("([01][0-9]|2[0-3])[0-5][0-9]")},
+		{"wakeup interval", matches("1|2|3|4|6|8|12|24")},
+		{"report frequency", intRange(1, 24)},
+		{"continuous mode", checkBool},
+		{"continuous send interval", offOrRange(1, 1440)},
+		{"battery low percentage", offOrRange(5, 20)},
+		{"sensor enable", checkBool},
+		{"gsm report", intRange(0, 3)},
+		{"report destination", intRange(0, 1)},
+		{"temperature report mode", intRange(0, 3)},
+		{"temperature range", matches(`[+-][0-9]{2}[+-][0-9]{2}`)},
+		{"agps mode", matches("0|2")},
+	}, reserved(2)...)},
+	// geo id, report mode, longitude, latitude, radius, check interval
+	dbh.CMD_TYPE_GTGEO: {"GTGEO", append([]atField{
+		{"geo id", intRange(0, 4)},
+		{"report mode", intRange(0, 3)},
+		{"longitude", floatRange(-180, 180)},
+		{"latitude", floatRange(-90, 90)},
+		{"radius", intRange(50, 6000000)},
+		{"check interval", offOrRange(5, 1440)},
+	}, reserved(8)...)},
+}
+
+// the device accepts the commands of its own password only
+func encodeCmd(password string, cmd dbh.TCMD) ([]byte, error) {
+	serial := cmdSerial(cmd)
+	switch cmd.Type {
+	case dbh.CMD_TYPE_GTCTN, dbh.CMD_TYPE_GTFRI:
+		// params: continuous mode,continuous send interval, the fields of
+		// GTGBC, e.g. 1,5
+		p := strings.Split(cmd.Params, ",")
+		if len(p) != 2 {
+			return nil, dbh.ErrInvalidCmd
+		}
+		params := make([]string, 13)
+		params[11], params[12] = p[0], p[1]
+		return _AtCmds[dbh.CMD_TYPE_GTGBC].encode(password, params, serial)
+	case dbh.CMD_TYPE_REPINTV:
+		// params: interval, the continuous send interval in minutes
+		if !intRange(1, 1440)(cmd.Params) {
+			return nil, dbh.ErrInvalidCmd
+		}
+		params := make([]string, 13)
+		params[11], params[12] = "1", cmd.Params
+		return _AtCmds[dbh.CMD_TYPE_GTGBC].encode(password, params, serial)
+	case dbh.CMD_TYPE_SRVADDR:
+		// params: ip:port, the main server
+		ip, port, err := dbh.ParseSrvAddr(cmd.Params)
+		if err != nil {
+			return nil, err
+		}
+		params := []string{"", "", "", ip.String(), strconv.Itoa(port)}
+		return _AtCmds[dbh.CMD_TYPE_GTSRI].encode(password, params, serial)
+	}
+	c := _AtCmds[cmd.Type]
+	if c == nil {
+		return nil, dbh.ErrInvalidCmd
+	}
+	params := strings.Split(cmd.Params, ",")
+	if c.name == "GTGBC" && len(params) > 3 && params[2] != params[3] {
+		log.Error("new passwords mismatch: ", cmd.Params)
+		return nil, dbh.ErrInvalidCmd
+	}
+	return c.encode(password, params, serial)
+}
+
+// the new password of an acked GTGBC, empty if unchanged
+func newPassword(cmd dbh.TCMD) string {
+	if cmd.Type != dbh.CMD_TYPE_GTGBC {
+		return ""
+	}
+	params := strings.Split(cmd.Params, ",")
+	if len(params) < 3 {
+		return ""
+	}
+	return params[2]
+}
+
+// checked before the command is queued
+func validateCmd(cmd dbh.TCMD) error {
+	_, err := encodeCmd(DEFAULT_PASSWORD, cmd)
+	return err
+}
+
+// write the pending commands onto the session, also called by the session
+// registry once a new command is queued for the connected device
+func sendCmds(sess *dbh.Session) bool {
+	return dbh.SendCmds(sess, writeCmd)
+}
+
+func writeCmd(sess *dbh.Session, cmd dbh.TCMD) error {
+	password, err := dbh.GetDevicePassword(sess.DeviceId)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		password = DEFAULT_PASSWORD
+	}
+	buff, err := encodeCmd(password, cmd)
+	if err != nil {
+		return err
+	}
+	log.Debug("command to ", sess.Imei, ": ", string(buff))
+	_, err = sess.Write(buff)
+	return err
+}
+
+// register the session of the device and deliver its commands, nil if the
+// device is unknown
+func handleCmds(imei string, conn *net.Conn) *dbh.Session {
+	id, err := dbh.LookupDevice(imei, VENDOR_NAME, *conn)
+	if err != nil {
+		log.Error("device not existed: ", imei, err)
+		return nil
+	}
+	sess := dbh.Online(&dbh.Session{Imei: imei, DeviceId: id, Vendor: VENDOR_NAME,
+		Conn: *conn, Sender: sendCmds, Acks: true})
+	sess.DeliverCmds()
+	return sess
+}
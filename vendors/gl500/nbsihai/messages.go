@@ -9,7 +9,6 @@ package nbsihai
 import (
 	dbh "lbsas/database"
 	. "lbsas/datatypes"
-	"lbsas/utils"
 	"net"
 	"reflect"
 
@@ -61,7 +60,7 @@ func (m *MessageResp) Parse(parts []string, conn *net.Conn) bool {
 	log.Debug(reflect.TypeOf(m).String(), "paser called")
 	val := reflect.ValueOf(m).Elem()
 	if len(parts) != val.NumField() {
-		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", From ", (*conn).RemoteAddr())
+		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", From ", remoteAddr(conn))
 		return false
 	}
 	for i := 0; i < val.NumField(); i++ {
@@ -77,7 +76,7 @@ func (m *MessageResp) Parse(parts []string, conn *net.Conn) bool {
 	{
 		err := m.Validate()
 		if err != nil {
-			log.Error("ERROR", err, ", Buff:", parts, ", From:", (*conn).RemoteAddr())
+			log.Error("ERROR", err, ", Buff:", parts, ", From:", remoteAddr(conn))
 			return false
 		}
 	}
@@ -85,53 +84,50 @@ func (m *MessageResp) Parse(parts []string, conn *net.Conn) bool {
 	return true
 }
 
-func (s *MessageResp) SaveToDB(dbhelper *dbh.DbHelper) error {
-
-	id, err := dbh.GetIdByImei(string(s.UID))
-	if err != nil {
-		return err
-	}
-
-	tm := utils.GetTimestampFromString(s.GPSUTime).UnixNano() / 1000000
-
-	sqlStr := `INSERT INTO eventdata(deviceId, timestamp, 
-	     latitude, longitude, speed, heading) VALUES(?,?,?,?,?,?)`
-	stmt, err := dbhelper.Prepare(sqlStr)
-	if err != nil {
-		return err
-	}
-
-	defer stmt.Close()
-
-	_, err = stmt.Exec(id, tm, s.Latitude, s.Longitude, s.Speed, s.Azimuth)
-	if err != nil {
-		return err
-	}
-
-	stmt2, err := dbhelper.Prepare(`UPDATE devicelatestdata SET lastAckTime=?, 
-	    latitude=?, longitude=?, speed=?, heading=?, gpsTimestamp=?, updateTime=? where deviceId=?`)
-	if err != nil {
-		return err
-	}
-
-	defer stmt2.Close()
-
-	_, err = stmt2.Exec(tm, s.Latitude, s.Longitude, s.Speed, s.Azimuth, tm, tm, id)
-	if err != nil {
-		return err
+// the geo-fence of GTGEO and whether it's entered or left, the motion
+// state change of GTNMR, 1 from rest to motion
+func (s *MessageResp) data() string {
+	switch eventOf(s.Command) {
+	case "GTGEO":
+		return eventData([]string{"geo", "enter"}, [][]byte{s.RID, s.RType})
+	case "GTNMR":
+		return eventData([]string{"moving"}, [][]byte{s.RType})
 	}
+	return ""
+}
 
-	return nil
+func (s *MessageResp) SaveToDB(dbhelper *dbh.DbHelper) error {
+	tm := reportTime(s.Command, s.GPSUTime, s.SendTime)
+	return dbh.SaveEvent(&dbh.Position{Imei: string(s.UID), Lat: string(s.Latitude), Lon: string(s.Longitude),
+		Speed: string(s.Speed), Heading: string(s.Azimuth), Ts: tm, Battery: string(s.BattPecent),
+		Event: eventOf(s.Command), Data: s.data(), Backfill: backfilled(s.Command)}, dbhelper)
 }
 
 //
-// ACK message
-type ACKMsgGTGBC struct {
+// ACK message, +ACK:GTGBC,110102,135790246811220,,0,0008,20100310172830,11F0$
+// the acks of GTGBC, GTGEO and GTWLT have the ID of the group, the zone or
+// the number before the serial number
+type MessageAck struct {
 	Command, //10
 	Version, //6
-	UID, //15, XX0000-XX-FFFF
-	Name, //10, IMEI
-	SeqNum, //4, 0000-FFFF
+	UID, //15, IMEI
+	Name, //10
+	ID, //<=2, optional
+	SerialNum, //4, 0000-FFFF, of the command
 	SendTime, //14
 	CntNum []byte //4, 0000-FFFF
 }
+
+func (m *MessageAck) Parse(parts []string, conn *net.Conn) bool {
+	if len(parts) != 7 && len(parts) != 8 {
+		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", From ", remoteAddr(conn))
+		return false
+	}
+	n := len(parts)
+	m.Command, m.Version, m.UID, m.Name = []byte(parts[0]), []byte(parts[1]), []byte(parts[2]), []byte(parts[3])
+	if n == 8 {
+		m.ID = []byte(parts[4])
+	}
+	m.SerialNum, m.SendTime, m.CntNum = []byte(parts[n-3]), []byte(parts[n-2]), []byte(parts[n-1])
+	return true
+}
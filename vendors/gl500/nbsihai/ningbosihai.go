@@ -11,7 +11,6 @@ import (
 	"fmt"
 	dbh "lbsas/database"
 	. "lbsas/datatypes"
-	gcj "lbsas/gcj02"
 	"net"
 	"strconv"
 	"strings"
@@ -20,6 +19,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+const VENDOR_NAME = "gl500"
+
 // module exported global variables
 type NbSiHai struct {
 	TcpConfig NetConfig
@@ -38,10 +39,28 @@ var _MessageConstants = &struct {
 		"RESP:GTCTN": MessageResp{},
 		"RESP:GTSTR": MessageResp{},
 		"RESP:GTRTL": MessageResp{},
-		"RESP:GTBL":  MessageResp{},
+		"RESP:GTNMR": MessageResp{},
+		"RESP:GTGEO": MessageResp{},
+		"RESP:GTBPL": MessageAlarm{},
+		"RESP:GTTEM": MessageAlarm{},
+		"RESP:GTPNA": MessageEvent{},
+		"RESP:GTPDP": MessageEvent{},
+		"RESP:GTDIF": MessageEvent{},
+		"RESP:GTCSQ": MessageEvent{},
+		"RESP:GTCID": MessageEvent{},
+		"RESP:GTTMZ": MessageEvent{},
+		"RESP:GTGSM": MessageGsm{},
+		"RESP:GTALL": MessageConfig{},
 		"BUFF:GTCTN": MessageResp{},
 		"BUFF:GTSTR": MessageResp{},
 		"BUFF:GTRTL": MessageResp{},
+		"BUFF:GTNMR": MessageResp{},
+		"BUFF:GTGEO": MessageResp{},
+		"BUFF:GTBPL": MessageAlarm{},
+		"BUFF:GTTEM": MessageAlarm{},
+		"BUFF:GTPNA": MessageEvent{},
+		"BUFF:GTPDP": MessageEvent{},
+		"BUFF:GTGSM": MessageGsm{},
 	},
 	byte(','),
 }
@@ -59,6 +78,7 @@ func New(env *EnviromentCfg) *NbSiHai {
 
 	return &NbSiHai{
 		NetConfig{ // flags
+			Vendor:         VENDOR_NAME,
 			Addr:           env.TCPAddr,
 			HttpAddr:       env.HTTPAddr,
 			Protocol:       "tcp",
@@ -70,45 +90,47 @@ func New(env *EnviromentCfg) *NbSiHai {
 			EndSymbol:      '$',
 			LogLevel:       env.LogLevel,
 			DBAddr:         env.DBAddr,
+			TLSConfig:      env.TLSConfig,
+			QueuePolicy:    env.QueuePolicy,
+			SpillDir:       env.SpillDir,
+			SpillMaxMB:     env.SpillMaxMB,
 		},
 		dbHelper, VendorStat{},
 	}
 }
 
-// packet consumer
-func (s *NbSiHai) TcpWorker(packetsChan chan *RawTcpPacket) {
+// packet consumer, called by the workers of the listener pool
+func (s *NbSiHai) HandlePacket(packet *RawTcpPacket) bool {
 	// all time related calculations can be safely ignored when review
-	isFirstTime := true
-	for {
-		timeLast := time.Now()
-
-		// get a packet from the pipe
-		packet := <-packetsChan
-
-		success := false
-		// handle channel close event
-		if packet == nil {
-			log.Debug("nil packet, close connection")
-			break
-		} else {
-			// data packet
-			if success = s.handlePacket(packet); !success {
-				s.Stat.NumInvalidPackets++
-				continue
-			}
-		}
-		// micro sec
-		var delta uint64 = uint64((time.Now().UnixNano() - timeLast.UnixNano()) / 1000)
-		if isFirstTime {
-			isFirstTime = false
-		} else {
-			if s.Stat.AvgWorkerTimeMicroSec == 0 {
-				s.Stat.AvgWorkerTimeMicroSec = delta
-			} else {
-				s.Stat.AvgWorkerTimeMicroSec = (s.Stat.AvgWorkerTimeMicroSec + delta) / 2
-			}
-		}
+	timeLast := time.Now()
+
+	// data packet
+	if !s.handlePacket(packet) {
+		s.Stat.NumInvalidPackets++
+		return false
+	}
+
+	// micro sec
+	var delta uint64 = uint64((time.Now().UnixNano() - timeLast.UnixNano()) / 1000)
+	if s.Stat.AvgWorkerTimeMicroSec == 0 {
+		s.Stat.AvgWorkerTimeMicroSec = delta
+	} else {
+		s.Stat.AvgWorkerTimeMicroSec = (s.Stat.AvgWorkerTimeMicroSec + delta) / 2
+	}
+	return true
+}
+
+// device identity of a packet, +RESP:GTCTN,110107,135790246811220,...
+func (s *NbSiHai) DeviceKey(buff []byte) string {
+	return deviceKey(buff)
+}
+
+func deviceKey(buff []byte) string {
+	parts := bytes.SplitN(buff, []byte{_MessageConstants.Delimiter}, 4)
+	if len(parts) < 4 {
+		return ""
 	}
+	return string(parts[2])
 }
 
 // helper function
@@ -121,9 +143,13 @@ func (s *NbSiHai) GetCfg() *NetConfig {
 	return &(s.TcpConfig)
 }
 
+func (s *NbSiHai) GetStat() *VendorStat {
+	return &(s.Stat)
+}
+
+// the database helper is shared by all the listeners, leave it open
 func (s *NbSiHai) Close() {
-	s.Close()
-	close(s.DBMsgChan)
+	log.Info("listener closed: ", s.TcpConfig.Vendor, "@", s.TcpConfig.Addr)
 }
 
 func (s *NbSiHai) SetLogLevel(lvl log.Level) {
@@ -164,72 +190,116 @@ func (s *NbSiHai) handlePacket(packet *RawTcpPacket) bool {
 
 // parse one message in a packet
 func (s *NbSiHai) parseMessage(parts []string, conn *net.Conn) interface{} {
-	var err error = nil
-	var lat, lng float64
+	dbmsg := decodeMessage(parts, conn)
+	if dbmsg != nil {
+		// put the message onto the database pipe, assured!!
+		if !s.Put(parts[2], dbmsg) {
+			s.Stat.DBWriteMsgDropped++
+		}
+	}
+
+	return nil
+}
+
+// serial number of a command, echoed by its ack
+func cmdSerial(cmd dbh.TCMD) string {
+	id, _ := strconv.ParseInt(cmd.Id, 10, 64)
+	return fmt.Sprintf("%04X", id&0xFFFF)
+}
+
+// the heartbeat keeps the session of the device, it expects a SACK
+func handleHeartbeat(parts []string, conn *net.Conn) {
+	hbd := MessageHeartbeat{}
+	if !hbd.Parse(parts, conn) {
+		return
+	}
+	log.Debug("heartbeat from ", string(hbd.UID), "@", remoteAddr(conn))
+	sess := handleCmds(string(hbd.UID), conn)
+	if sess == nil {
+		return
+	}
+	if _, err := sess.Write(hbd.Reply()); err != nil {
+		log.Error("can't reply the heartbeat of ", string(hbd.UID), ": ", err)
+	}
+}
+
+// the sent command of the serial number is acked
+func handleAck(parts []string, conn *net.Conn) {
+	ack := MessageAck{}
+	if !ack.Parse(parts, conn) {
+		return
+	}
+	id, err := dbh.GetIdByImei(string(ack.UID))
+	if err != nil {
+		log.Error("ack of unknown device: ", string(ack.UID), ", ", err)
+		return
+	}
+	serial := strings.ToUpper(string(ack.SerialNum))
+	// the serials wrap at 0xFFFF, the oldest sent one takes the ack
+	cmd, ok := dbh.AckCmd(id, func(cmd dbh.TCMD) bool {
+		return cmdSerial(cmd) == serial
+	})
+	// the following commands must use the new password
+	if pwd := newPassword(cmd); ok && pwd != "" {
+		if err := dbh.SetDevicePassword(id, pwd); err != nil {
+			log.Error("can't set the password of ", string(ack.UID), ": ", err)
+		}
+	}
+}
+
+// decode one message, shared by the tcp vendor and the tcp2 proto.
+// returns the message to be stored, nil if invalid
+func decodeMessage(parts []string, conn *net.Conn) dbh.IDBMessage {
+	if parts[0] == _MessageConstants.ClassACK+"GTHBD" {
+		handleHeartbeat(parts, conn)
+		return nil
+	}
+	if strings.HasPrefix(parts[0], _MessageConstants.ClassACK) {
+		handleAck(parts, conn)
+		return nil
+	}
+
+	var dbmsg dbh.IDBMessage
+	uid := ""
 	if par := _MessageConstants.Commands[parts[0]]; par != nil {
 		switch par.(type) {
 		case MessageResp:
-			_par := MessageResp{}
+			_par := &MessageResp{}
+			if _par.Parse(parts, conn) &&
+				convertGPS(&_par.Latitude, &_par.Longitude, &_par.Speed, &_par.Azimuth, &_par.Altitude, parts, conn) {
+				dbmsg, uid = _par, string(_par.UID)
+			}
+		case MessageAlarm:
+			_par := &MessageAlarm{}
+			if _par.Parse(parts, conn) &&
+				convertGPS(&_par.Latitude, &_par.Longitude, &_par.Speed, &_par.Azimuth, &_par.Altitude, parts, conn) {
+				dbmsg, uid = _par, string(_par.UID)
+			}
+		case MessageEvent:
+			_par := &MessageEvent{}
 			if _par.Parse(parts, conn) {
-				// convert WGS to GCJ-02
-				// false back
-				falseBack := false
-				if len(_par.Altitude) == 0 {
-					_par.Altitude = []byte("0")
-					falseBack = true
-				}
-				if len(_par.Longitude) == 0 {
-					_par.Longitude = []byte("0")
-					falseBack = true
-				}
-				if len(_par.Speed) == 0 {
-					_par.Speed = []byte("0")
-					falseBack = true
-				}
-				if len(_par.Azimuth) == 0 {
-					_par.Azimuth = []byte("0")
-					falseBack = true
-				}
-				if len(_par.Latitude) == 0 {
-					_par.Latitude = []byte("0")
-					falseBack = true
-				}
-
-				lat, err = strconv.ParseFloat(string(_par.Latitude), 64)
-				if err == nil {
-					lng, err = strconv.ParseFloat(string(_par.Longitude), 64)
-					if err == nil {
-						lat, lng = gcj.WGStoBD(lat, lng)
-						_par.Latitude = []byte(strconv.FormatFloat(lat, 'f', 6, 64))
-						_par.Longitude = []byte(strconv.FormatFloat(lng, 'f', 6, 64))
-					}
-				}
-				if falseBack || err != nil {
-					log.Error(err, ", Buff:", parts, ", From:", (*conn).RemoteAddr())
-				}
-
-				if err == nil {
-					// put the message onto the database pipe, assured!!
-					// the for-select-break style is my innovation? :)
-					for {
-						select {
-						case s.DBMsgChan <- &_par:
-							goto BREAK_
-						default:
-							// database pipe overflow, pop the oldest one and insert the new one
-							<-s.DBMsgChan
-							s.Stat.DBWriteMsgDropped++
-						}
-					}
-				BREAK_:
-				}
+				dbmsg, uid = _par, string(_par.UID)
+			}
+		case MessageGsm:
+			_par := &MessageGsm{}
+			if _par.Parse(parts, conn) {
+				dbmsg, uid = _par, string(_par.UID)
+			}
+		case MessageConfig:
+			// nothing to store
+			if len(parts) > 2 {
+				log.Info("configuration of ", parts[2], ": ", strings.Join(parts[3:], ","))
+				handleCmds(parts[2], conn)
 			}
 		default:
-			log.Error("unkown message", parts, "From", (*conn).RemoteAddr().String())
+			log.Error("unkown message", parts, "From", remoteAddr(conn))
 		}
 	} else {
-		log.Error("unkown cmd", parts, "From", (*conn).RemoteAddr().String())
+		log.Error("unkown cmd", parts, "From", remoteAddr(conn))
 	}
 
-	return nil
+	if dbmsg == nil || handleCmds(uid, conn) == nil {
+		return nil
+	}
+	return dbmsg
 }
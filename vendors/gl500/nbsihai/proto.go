@@ -0,0 +1,94 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package nbsihai
+
+import (
+	"bytes"
+	dbh "lbsas/database"
+	"lbsas/tcp2"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	START_SYMBOL = byte('+')
+	END_SYMBOL   = byte('$')
+)
+
+// GL500 text protocol on the tcp2 framework, one message per instance:
+// +RESP:GTCTN,...,0011$
+type GL500 struct {
+	buff  []byte
+	conn  *net.Conn
+	dbmsg dbh.IDBMessage
+}
+
+func NewProto() dbh.IGPSProto {
+	return &GL500{}
+}
+
+func (s *GL500) New(args ...interface{}) dbh.IGPSProto {
+	if len(args) == 2 {
+		if buff, ok := args[0].([]byte); ok {
+			if conn, ok := args[1].(*net.Conn); ok {
+				return &GL500{buff: buff, conn: conn}
+			}
+		}
+	}
+	return nil
+}
+
+// +RESP:, +BUFF:, +ACK:, ...
+func (s *GL500) IsValid() bool {
+	if len(s.buff) < 1 || s.buff[0] != START_SYMBOL {
+		return false
+	}
+	for _, v := range []string{_MessageConstants.ClassReport, _MessageConstants.ClassBuff,
+		_MessageConstants.ClassACK, _MessageConstants.ClassAT} {
+		if bytes.HasPrefix(s.buff[1:], []byte(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// a message ends at the first '$', the trailing CR/LF is part of it
+func (s *GL500) IsWhole() int {
+	i := bytes.IndexByte(s.buff, END_SYMBOL)
+	if i < 0 {
+		return -1
+	}
+	end := i + 1
+	for end < len(s.buff) && (s.buff[end] == '\r' || s.buff[end] == '\n') {
+		end++
+	}
+	return len(s.buff) - end
+}
+
+func (s *GL500) DeviceKey() string {
+	return deviceKey(s.buff)
+}
+
+// true to store in DB, false otherwise
+func (s *GL500) HandleMsg() bool {
+	buff := bytes.TrimRight(s.buff, "\r\n")
+	if len(buff) < 2 || buff[0] != START_SYMBOL || buff[len(buff)-1] != END_SYMBOL {
+		log.Error("Invalid packet. Buff:", string(s.buff), ", From:", (*s.conn).RemoteAddr())
+		return false
+	}
+
+	parts := strings.Split(string(buff[1:len(buff)-1]), string(_MessageConstants.Delimiter))
+	s.dbmsg = decodeMessage(parts, s.conn)
+	return s.dbmsg != nil
+}
+
+func (s *GL500) SaveToDB(dbHelper *dbh.DbHelper) error {
+	return s.dbmsg.SaveToDB(dbHelper)
+}
+
+func init() {
+	tcp2.Register(VENDOR_NAME, NewProto())
+	dbh.RegisterCmdValidator(VENDOR_NAME, validateCmd)
+}
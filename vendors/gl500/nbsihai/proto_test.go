@@ -0,0 +1,168 @@
+package nbsihai
+
+import (
+	dbh "lbsas/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGL500IsWhole(t *testing.T) {
+	msg := "+RESP:GTCTN,110107,135790246811220,,0,0,1,1,25.0,100,1,0.0,0,0.0,121.390875,31.164600," +
+		"20150612193050,0460,0000,18d8,6141,,,20150612193052,0011$"
+	cases := []struct {
+		buff  string
+		valid bool
+		whole int
+	}{
+		{msg, true, 0},
+		{msg + "\r\n", true, 0},
+		{msg + msg, true, len(msg)},
+		{msg[:50], true, -1},
+		{"+ACK:GTHBD,", true, -1},
+		{"*HQ,8150708207,", false, -1},
+	}
+	for _, v := range cases {
+		p := &GL500{buff: []byte(v.buff)}
+		if p.IsValid() != v.valid {
+			t.Error("valid expected", v.valid, "for", v.buff)
+		}
+		if whole := p.IsWhole(); whole != v.whole {
+			t.Error("expected", v.whole, "got", whole, "for", v.buff)
+		}
+	}
+}
+
+func TestGL500Ack(t *testing.T) {
+	cases := []struct {
+		msg, serial string
+	}{
+		{"ACK:GTBSI,110102,135790246811220,,0002,20100310172830,11F0", "0002"},
+		{"ACK:GTGBC,110102,135790246811220,,0,0008,20100310172830,11F0", "0008"},
+	}
+	for _, v := range cases {
+		ack := MessageAck{}
+		if !ack.Parse(strings.Split(v.msg, ","), nil) || string(ack.SerialNum) != v.serial ||
+			string(ack.UID) != "135790246811220" {
+			t.Error("unexpected ack of", v.msg, ":", string(ack.SerialNum))
+		}
+	}
+	// malformed, without a connection
+	if (&MessageAck{}).Parse([]string{"ACK:GTBSI", "110102"}, nil) {
+		t.Error("expected invalid ack")
+	}
+	if s := cmdSerial(dbh.TCMD{Id: "65546"}); s != "000A" {
+		t.Error("unexpected serial:", s)
+	}
+}
+
+func TestEncodeCmd(t *testing.T) {
+	cases := []struct {
+		cmd dbh.TCMD
+		out string
+	}{
+		{dbh.TCMD{Id: "2", Type: dbh.CMD_TYPE_GTBSI, Params: "cmnet"}, "AT+GTBSI=gl500,cmnet,,,,,,,0002$"},
+		{dbh.TCMD{Id: "3", Type: dbh.CMD_TYPE_GTSRI, Params: "3,,,116.226.44.17,9001,116.226.44.16,9002,,0,1"},
+			"AT+GTSRI=gl500,3,,,116.226.44.17,9001,116.226.44.16,9002,,0,1,,,,,0003$"},
+		{dbh.TCMD{Id: "6", Type: dbh.CMD_TYPE_GTTMA, Params: "-,3,30,0,20090917203500"},
+			"AT+GTTMA=gl500,-,3,30,0,20090917203500,,,,,0006$"},
+		{dbh.TCMD{Id: "8", Type: dbh.CMD_TYPE_GTGEO, Params: "0,3,101.412248,21.187891,1000,15"},
+			"AT+GTGEO=gl500,0,3,101.412248,21.187891,1000,15,,,,,,,,,0008$"},
+		{dbh.TCMD{Id: "165", Type: dbh.CMD_TYPE_GTGBC,
+			Params: "+8613585715149,GL500,,,003F,,,10101010101010,1400,12,2,1,15,10,1,1,1,1,,2"},
+			"AT+GTGBC=gl500,+8613585715149,GL500,,,003F,,,10101010101010,1400,12,2,1,15,10,1,1,1,1,,2,,,00A5$"},
+		{dbh.TCMD{Id: "16", Type: dbh.CMD_TYPE_REPINTV, Params: "30"},
+			"AT+GTGBC=gl500,,,,,,,,,,,,1,30,,,,,,,,,,0010$"},
+		{dbh.TCMD{Id: "17", Type: dbh.CMD_TYPE_SRVADDR, Params: "10.0.0.1:9001"},
+			"AT+GTSRI=gl500,,,,10.0.0.1,9001,,,,,,,,,,0011$"},
+		{dbh.TCMD{Id: "18", Type: dbh.CMD_TYPE_GTCTN, Params: "1,5"},
+			"AT+GTGBC=gl500,,,,,,,,,,,,1,5,,,,,,,,,,0012$"},
+		{dbh.TCMD{Id: "19", Type: dbh.CMD_TYPE_GTFRI, Params: "0,"},
+			"AT+GTGBC=gl500,,,,,,,,,,,,0,,,,,,,,,,,0013$"},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTCTN, Params: "1"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTFRI, Params: "2,5"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTGEO, Params: "5"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTSRI, Params: "3,1"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTBSI, Params: "cmnet,,,,,,,,"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_GTGBC, Params: ",,abcd,abce"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_REPINTV, Params: "0"}, ""},
+		{dbh.TCMD{Type: dbh.CMD_TYPE_WORKMODE, Params: "1"}, ""},
+	}
+	for _, v := range cases {
+		buff, err := encodeCmd(DEFAULT_PASSWORD, v.cmd)
+		if string(buff) != v.out || (err == nil) != (v.out != "") {
+			t.Error("unexpected command of", v.cmd.Type, v.cmd.Params, ":", string(buff), err)
+		}
+	}
+	if pwd := newPassword(dbh.TCMD{Type: dbh.CMD_TYPE_GTGBC, Params: ",,abcd,abcd"}); pwd != "abcd" {
+		t.Error("unexpected new password:", pwd)
+	}
+}
+
+func TestGL500Reports(t *testing.T) {
+	geo := MessageResp{}
+	if !geo.Parse(strings.Split("RESP:GTGEO,110103,135790246811220,GL500,3,1,0,25.1,100,2,0.1,0,5.7,"+
+		"121.390839,31.164621,20130311080111,0460,0000,1877,0873,,,,20130311080112,00A7", ","), nil) ||
+		geo.data() != "geo=3;enter=1" {
+		t.Error("unexpected geo-fence report:", geo.data())
+	}
+
+	bpl := MessageAlarm{}
+	if !bpl.Parse(strings.Split("RESP:GTBPL,110102,135790246811220,GL500,2,25.0,4,0,0.5,0,0.1,121.390978,"+
+		"31.164529,20130228202357,0460,0000,1877,0873,,,,20130228202742,018B", ","), nil) ||
+		bpl.data() != "battery=4" || eventOf(bpl.Command) != "GTBPL" {
+		t.Error("unexpected low battery report:", bpl.data())
+	}
+
+	cases := []struct {
+		msg, data string
+	}{
+		{"RESP:GTPNA,020102,135790246811220,,4,20100214093254,11F0", "type=4"},
+		{"RESP:GTPDP,110202,135790246811220,,20100214093254,11F0", ""},
+		{"RESP:GTCSQ,020102,135790246811220,,16,0,20100214093254,11F0", "rssi=16;ber=0"},
+		{"RESP:GTTMZ,020102,135790246811220,-0330,0,20100214093254,11F0", "offset=-0330;dst=0"},
+		{"RESP:GTDIF,020102,135790246811220,,GL500,0,25.0,80,0100,0101,0103,20100214093000,20100214093254,11F0",
+			"deviceType=GL500;moveStat=0;temperature=25.0;battery=80;firmware=0100;hardware=0101;mcu=0103;lastFix=20100214093000"},
+	}
+	for _, v := range cases {
+		m := MessageEvent{}
+		if !m.Parse(strings.Split(v.msg, ","), nil) || string(m.UID) != "135790246811220" ||
+			eventData(_EventFields[eventOf(m.Command)], m.Values) != v.data {
+			t.Error("unexpected event of", v.msg, ":", eventData(_EventFields[eventOf(m.Command)], m.Values))
+		}
+	}
+	if (&MessageEvent{}).Parse(strings.Split("RESP:GTCSQ,020102,135790246811220,16,20100214093254,11F0", ","), nil) {
+		t.Error("expected an invalid report")
+	}
+
+	gsm := MessageGsm{}
+	if !gsm.Parse(strings.Split("RESP:GTGSM,110102,135790246811220,CTN,0460,0000,1877,0871,27,,0460,0000,1806,3152,27,,"+
+		"0460,0000,1806,2152,17,,0460,0000,1877,03A3,13,,,,,,,,,,,,,,0460,0000,1877,0873,31,,20130316013544,034B", ","), nil) ||
+		string(gsm.CID) != "0873" || string(gsm.FixType) != "CTN" {
+		t.Error("unexpected cells:", string(gsm.CID))
+	}
+
+	hbd := MessageHeartbeat{}
+	if !hbd.Parse(strings.Split("ACK:GTHBD,110102,135790246811220,,20100214093254,11F0", ","), nil) ||
+		string(hbd.Reply()) != "+SACK:GTHBD,110102,11F0$" {
+		t.Error("unexpected heartbeat reply:", string(hbd.Reply()))
+	}
+}
+
+func TestGL500ReportTime(t *testing.T) {
+	// 2013-03-12T18:39:36Z
+	old := []byte("20130312183936")
+	if ts := reportTime([]byte("BUFF:GTCTN"), old); ts != 1363113576000 {
+		t.Error("unexpected time of a buffered report:", ts)
+	}
+	// no gps fix, the send time
+	if ts := reportTime([]byte("BUFF:GTCTN"), nil, old); ts != 1363113576000 {
+		t.Error("unexpected time of a buffered report:", ts)
+	}
+	if ts := reportTime([]byte("RESP:GTCTN"), old); ts < time.Now().Add(-time.Minute).UnixNano()/1000000 {
+		t.Error("unexpected time of a live report:", ts)
+	}
+	if !backfilled([]byte("BUFF:GTPNA")) || backfilled([]byte("RESP:GTPNA")) {
+		t.Error("unexpected backfill flags")
+	}
+}
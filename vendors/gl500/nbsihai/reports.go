@@ -0,0 +1,262 @@
+// Copyright 2015 ZheJiang QunShuo Inc. All rights reserved
+
+package nbsihai
+
+import (
+	dbh "lbsas/database"
+	. "lbsas/datatypes"
+	gcj "lbsas/gcj02"
+	"lbsas/utils"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// the values of the reports without gps data, between the device name and
+// the send time. the device name is left out by some firmwares
+var _EventFields = map[string][]string{
+	// power on type: 1 movement, 2 specified time, 4 manual, 5 RTO reboot
+	"GTPNA": {"type"},
+	// gprs pdp context established
+	"GTPDP": {},
+	// device info, GL500 has no GTINF
+	"GTDIF": {"deviceType", "moveStat", "temperature", "battery", "firmware", "hardware", "mcu", "lastFix"},
+	// replies to AT+GTRTO
+	"GTCSQ": {"rssi", "ber"},
+	"GTCID": {"iccid"},
+	"GTTMZ": {"offset", "dst"},
+}
+
+func remoteAddr(conn *net.Conn) string {
+	if conn == nil {
+		return ""
+	}
+	return (*conn).RemoteAddr().String()
+}
+
+// RESP:GTCTN -> GTCTN
+func eventOf(command []byte) string {
+	name := string(command)
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// +BUFF: reports, buffered while the device was out of coverage
+func backfilled(command []byte) bool {
+	return strings.HasPrefix(string(command), _MessageConstants.ClassBuff)
+}
+
+// the first valid one of the times in ms. the buffered reports keep their
+// own time, the live ones are checked against the current time
+func reportTime(command []byte, tms ...[]byte) int64 {
+	if backfilled(command) {
+		for _, tm := range tms {
+			t, err := utils.ParseTimestamp(tm)
+			if err == nil && t.Before(time.Now().Add(utils.SECS_15MINUTE*time.Second)) {
+				return t.UnixNano() / 1000000
+			}
+		}
+		log.Warn("buffered report without valid time: ", string(command), ", ", tms)
+	}
+	return utils.GetTimestampFromString(tms[0]).UnixNano() / 1000000
+}
+
+// key=value pairs of the non empty values
+func eventData(keys []string, values [][]byte) string {
+	ret := make([]string, 0, len(keys))
+	for i, k := range keys {
+		if i < len(values) && len(values[i]) > 0 {
+			ret = append(ret, k+"="+string(values[i]))
+		}
+	}
+	return strings.Join(ret, ";")
+}
+
+// one field per []byte member of m
+func parseFields(m interface{}, parts []string, conn *net.Conn) bool {
+	val := reflect.ValueOf(m).Elem()
+	if len(parts) != val.NumField() {
+		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", Buff:", parts, ", From ", remoteAddr(conn))
+		return false
+	}
+	for i := 0; i < val.NumField(); i++ {
+		val.Field(i).SetBytes([]byte(parts[i]))
+	}
+	return true
+}
+
+// convert the WGS position of a report to BD-09, the missing values are 0
+func convertGPS(lat, lng, speed, azimuth, alt *[]byte, parts []string, conn *net.Conn) bool {
+	falseBack := false
+	for _, v := range []*[]byte{alt, lng, speed, azimuth, lat} {
+		if len(*v) == 0 {
+			*v = []byte("0")
+			falseBack = true
+		}
+	}
+
+	la, err := strconv.ParseFloat(string(*lat), 64)
+	if err == nil {
+		var lo float64
+		lo, err = strconv.ParseFloat(string(*lng), 64)
+		if err == nil {
+			la, lo = gcj.WGStoBD(la, lo)
+			*lat = []byte(strconv.FormatFloat(la, 'f', 6, 64))
+			*lng = []byte(strconv.FormatFloat(lo, 'f', 6, 64))
+		}
+	}
+	if falseBack || err != nil {
+		log.Error(err, ", Buff:", parts, ", From:", remoteAddr(conn))
+	}
+	return err == nil
+}
+
+// +RESP:GTBPL and +RESP:GTTEM, the alarms have no report id and type
+type MessageAlarm struct {
+	Command, //10
+	Version, //6
+	UID, //15, IMEI
+	Name, //10
+	MoveStat, //1, 0|1|2
+	Temperature, //4, xx.x
+	BattPecent, //3, 0-100
+	GPSAccuracy, //<=2, 0|1-50
+	Speed, //<=5, 0.0-999.9km/h
+	Azimuth, //<=3, 0-359
+	Altitude, //<=8, -xxxxx.x
+	Longitude, //<=11, -xxx.xxxxx
+	Latitude, //<=10, -xx.xxxxxx
+	GPSUTime, //14, YYYYMMDDHHMMSS
+	MCC, //4, 0XXX
+	MNC, //4, 0XXX
+	LAC, //4, XXXX
+	CID, //4, XXXX
+	R1, //0
+	R2,
+	R3,
+	SendTime, //14
+	SeqNum []byte //4, 0000-FFFF
+}
+
+func (m *MessageAlarm) Parse(parts []string, conn *net.Conn) bool {
+	return parseFields(m, parts, conn)
+}
+
+// the battery percentage of GTBPL, the temperature of GTTEM
+func (m *MessageAlarm) data() string {
+	if eventOf(m.Command) == "GTBPL" {
+		return eventData([]string{"battery"}, [][]byte{m.BattPecent})
+	}
+	return eventData([]string{"temperature"}, [][]byte{m.Temperature})
+}
+
+func (m *MessageAlarm) SaveToDB(dbhelper *dbh.DbHelper) error {
+	tm := reportTime(m.Command, m.GPSUTime, m.SendTime)
+	return dbh.SaveEvent(&dbh.Position{Imei: string(m.UID), Lat: string(m.Latitude), Lon: string(m.Longitude),
+		Speed: string(m.Speed), Heading: string(m.Azimuth), Ts: tm, Battery: string(m.BattPecent),
+		Event: eventOf(m.Command), Data: m.data(), Backfill: backfilled(m.Command)}, dbhelper)
+}
+
+// a report without gps data, the values are named by _EventFields
+type MessageEvent struct {
+	Command, //10
+	Version, //6
+	UID []byte //15, IMEI
+	Values    [][]byte
+	SendTime, //14
+	CntNum []byte //4, 0000-FFFF
+}
+
+func (m *MessageEvent) Parse(parts []string, conn *net.Conn) bool {
+	n, k := len(parts), len(_EventFields[eventOf([]byte(parts[0]))])
+	if n != 5+k && n != 6+k {
+		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", Buff:", parts, ", From ", remoteAddr(conn))
+		return false
+	}
+	m.Command, m.Version, m.UID = []byte(parts[0]), []byte(parts[1]), []byte(parts[2])
+	m.Values = make([][]byte, k)
+	for i := range m.Values {
+		m.Values[i] = []byte(parts[n-2-k+i])
+	}
+	m.SendTime, m.CntNum = []byte(parts[n-2]), []byte(parts[n-1])
+	return true
+}
+
+// the value named by _EventFields, empty if the report has none
+func (m *MessageEvent) value(name string) string {
+	for i, k := range _EventFields[eventOf(m.Command)] {
+		if k == name && i < len(m.Values) {
+			return string(m.Values[i])
+		}
+	}
+	return ""
+}
+
+func (m *MessageEvent) SaveToDB(dbhelper *dbh.DbHelper) error {
+	event := eventOf(m.Command)
+	tm := reportTime(m.Command, m.SendTime)
+	return dbh.SaveEvent(&dbh.Position{Imei: string(m.UID), Ts: tm, NoGPS: true, Backfill: backfilled(m.Command),
+		Battery: m.value("battery"), Event: event, Data: eventData(_EventFields[event], m.Values)}, dbhelper)
+}
+
+// +RESP:GTGSM, the cells seen by the device: fix type, 6 neighbour cells
+// and the serving cell of mcc, mnc, lac, cell id, rxlevel and a reserved
+// field each. only the serving cell is kept
+type MessageGsm struct {
+	Command, //10
+	Version, //6
+	UID, //15, IMEI
+	FixType []byte // STR|CTN|NMR|RTL
+	MCC, MNC, LAC, CID, RxLevel []byte
+	SendTime,                   //14
+	CntNum []byte //4, 0000-FFFF
+}
+
+func (m *MessageGsm) Parse(parts []string, conn *net.Conn) bool {
+	n := len(parts)
+	if n != 48 {
+		log.Error(ErrorMessage["INVALID_PACKET_LEN"], ", Buff:", parts, ", From ", remoteAddr(conn))
+		return false
+	}
+	m.Command, m.Version, m.UID, m.FixType = []byte(parts[0]), []byte(parts[1]), []byte(parts[2]), []byte(parts[3])
+	m.MCC, m.MNC, m.LAC, m.CID, m.RxLevel = []byte(parts[n-8]), []byte(parts[n-7]), []byte(parts[n-6]),
+		[]byte(parts[n-5]), []byte(parts[n-4])
+	m.SendTime, m.CntNum = []byte(parts[n-2]), []byte(parts[n-1])
+	return true
+}
+
+func (m *MessageGsm) SaveToDB(dbhelper *dbh.DbHelper) error {
+	tm := reportTime(m.Command, m.SendTime)
+	data := eventData([]string{"fix", "mcc", "mnc", "lac", "cid", "rxlevel"},
+		[][]byte{m.FixType, m.MCC, m.MNC, m.LAC, m.CID, m.RxLevel})
+	return dbh.SaveEvent(&dbh.Position{Imei: string(m.UID), Ts: tm, NoGPS: true, Backfill: backfilled(m.Command),
+		Event: eventOf(m.Command), Data: data}, dbhelper)
+}
+
+// +RESP:GTALL, the configuration read by AT+GTRTO, only logged
+type MessageConfig struct{}
+
+// +ACK:GTHBD,110102,135790246811220,,20100214093254,11F0$, the device
+// expects +SACK:GTHBD,110102,11F0$
+type MessageHeartbeat struct {
+	Command, //10
+	Version, //6
+	UID, //15, IMEI
+	Name, //10
+	SendTime, //14
+	CntNum []byte //4, 0000-FFFF
+}
+
+func (m *MessageHeartbeat) Parse(parts []string, conn *net.Conn) bool {
+	return parseFields(m, parts, conn)
+}
+
+func (m *MessageHeartbeat) Reply() []byte {
+	return []byte("+SACK:GTHBD," + string(m.Version) + "," + string(m.CntNum) + "$")
+}
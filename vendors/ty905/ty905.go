@@ -13,6 +13,8 @@ import (
 	"fmt"
 	dbh "lbsas/database"
 	. "lbsas/datatypes"
+	gcj "lbsas/gcj02"
+	"lbsas/utils"
 	"strconv"
 	"strings"
 
@@ -33,8 +35,13 @@ const (
 
 	GEO_DATA_LEN = 34
 	MINIMUM_LEN  = 11
+
+	// bit 7 of the fix status of the geo data
+	GEO_FIXED = byte(0x80)
 )
 
+// 29 29 <cmd> <length 2> <ip 4> <content> <checksum> 0d, the length counts
+// the bytes following it, the checksum is the xor of the bytes before it
 type Message struct {
 	MsgHead, // 2
 	MajorCmd, // 1
@@ -47,16 +54,46 @@ type Message struct {
 
 type TY905 struct {
 	rawPacket                      RawUdpPacket
+	msg                            *Message
 	imei, lat, lon, speed, heading string
 	gpsTime                        int64
+	// no fix, only the time of the report is known
+	noGPS bool
 }
 
 func New(rp RawUdpPacket) dbh.IGPSProto {
 	return &TY905{rawPacket: rp}
 }
 
+func checkSum(buff []byte) byte {
+	ret := byte(0)
+	for _, v := range buff {
+		ret ^= v
+	}
+	return ret
+}
+
+// split a frame into the message, nil if malformed or the checksum mismatches
+func parseMessage(buff []byte) *Message {
+	if len(buff) < MINIMUM_LEN || !bytes.Equal(buff[:2], []byte(MSG_HEAD)) {
+		return nil
+	}
+	n := 5 + int(binary.BigEndian.Uint16(buff[3:5]))
+	if n < MINIMUM_LEN || n > len(buff) || buff[n-1] != MSG_TAIL[0] {
+		log.Debug("invalid length: ", hex.EncodeToString(buff))
+		return nil
+	}
+	if sum := checkSum(buff[:n-2]); sum != buff[n-2] {
+		log.Warn("checksum mismatch, expected: ", sum, ", got: ", buff[n-2], ", buff: ", hex.EncodeToString(buff[:n]))
+		return nil
+	}
+	return &Message{MsgHead: buff[:2], MajorCmd: buff[2:3], Length: buff[3:5], IP: buff[5:9],
+		Content: buff[9 : n-2], CheckSum: buff[n-2 : n-1], MsgTail: buff[n-1 : n]}
+}
+
 func (s *TY905) IsValid() bool {
-	if len(s.rawPacket.Buff) > MINIMUM_LEN && bytes.Equal(s.rawPacket.Buff[:2], []byte(MSG_HEAD)) {
+	s.msg = parseMessage(s.rawPacket.Buff)
+	if s.msg != nil {
 		return true
 	}
 	log.Debug("invalid message: ", s.rawPacket.Buff)
@@ -77,23 +114,100 @@ func (s *TY905) New(args ...interface{}) dbh.IGPSProto {
 	return nil
 }
 
+func (s *TY905) DeviceKey() string {
+	if len(s.rawPacket.Buff) < 9 {
+		return s.rawPacket.Remote.String()
+	}
+	return hex.EncodeToString(s.rawPacket.Buff[5:9])
+}
+
 // true to store in DB, false otherwise
 func (s *TY905) HandleMsg() bool {
 	log.Debug("handlemsg called")
+	if s.msg == nil && !s.IsValid() {
+		return false
+	}
 	// s.rawPacket.UdpConn.WriteToUDP(s.rawPacket.Buff, s.rawPacket.Remote)
-	s.imei = "SHTY905" + strings.ToUpper(hex.EncodeToString(s.rawPacket.Buff[5:9]))
-
-	if s.rawPacket.Buff[2] == MSG_CMD_UP_NORM_GEO {
+	s.imei = "SHTY905" + strings.ToUpper(hex.EncodeToString(s.msg.IP))
+	id, err := dbh.LookupDevice(s.imei, "ty905", nil)
+	if err != nil {
+		log.Error("device not existed: ", s.imei, err)
+		return false
+	}
+	dbh.Online(&dbh.Session{Imei: s.imei, DeviceId: id, Vendor: "ty905",
+		UdpConn: s.rawPacket.UdpConn, Remote: s.rawPacket.Remote})
+
+	switch s.msg.MajorCmd[0] {
+	case MSG_CMD_UP_ACK:
+		s.handleAck()
+		return false
+	case MSG_CMD_UP_NORM_GEO:
+		return s.decodeGeo()
+	case MSG_CMD_UP_TIME_PROTO:
+		return s.decodeTime()
+	}
+	log.Debug("unknown message ", hex.EncodeToString(s.msg.MajorCmd), " from ", s.imei)
+	return false
+}
 
+// date and time, latitude, longitude, speed, heading, fix status, followed
+// by the mileage and vehicle status which are not kept:
+// YYMMDDhhmmss, ddmm.mmmm, dddmm.mmm, km/h, degree in bcd
+func (s *TY905) decodeGeo() bool {
+	c := s.msg.Content
+	if len(c) < GEO_DATA_LEN {
+		log.Error("invalid geo data of ", s.imei, ": ", hex.EncodeToString(c))
+		return false
+	}
+	s.gpsTime = utils.GetTimestampFromString([]byte(utils.DecodeTY905Time(c[:6]))).UnixNano() / 1000000
+	if c[18]&GEO_FIXED == 0 {
+		s.noGPS = true
+		return true
 	}
+	lat, lon := gcj.WGStoBD(float64(utils.DecodeTY905Lat(c[6:10])), float64(utils.DecodeTY905Lon(c[10:14])))
+	s.lat = strconv.FormatFloat(lat, 'f', 6, 64)
+	s.lon = strconv.FormatFloat(lon, 'f', 6, 64)
+	s.speed = strconv.Itoa(utils.DecodeTY905Int(c[14:16]))
+	s.heading = strconv.Itoa(utils.DecodeTY905Int(c[16:18]))
+	log.Debug("lat:", s.lat, " lon:", s.lon, " speed:", s.speed, " heading:", s.heading)
+	return true
+}
 
+// the timed report, the time of the device followed by the geo data if
+// it has a fix
+func (s *TY905) decodeTime() bool {
+	c := s.msg.Content
+	if len(c) >= GEO_DATA_LEN {
+		return s.decodeGeo()
+	}
+	if len(c) < 6 {
+		log.Error("invalid time data of ", s.imei, ": ", hex.EncodeToString(c))
+		return false
+	}
+	s.gpsTime = utils.GetTimestampFromString([]byte(utils.DecodeTY905Time(c[:6]))).UnixNano() / 1000000
+	s.noGPS = true
 	return true
 }
 
+// 29 29 85 00 0a <ip 4> <cmd> ... <checksum> 0d, the downlink cmd acked
+// follows the ip. no command is sent to TY905 yet, the acks are only logged
+func (s *TY905) handleAck() {
+	if len(s.msg.Content) == 0 {
+		log.Error("ack without downlink cmd from ", s.imei)
+		return
+	}
+	down := s.msg.Content[0]
+	log.Debug("ack of downlink ", hex.EncodeToString([]byte{down}), " from ", s.imei)
+	switch down {
+	case MSG_CMD_DOWN_REP, MSG_CMD_DOWN_CFG, MSG_CMD_DOWN_MSG:
+	default:
+		log.Warn("ack of unknown downlink ", hex.EncodeToString([]byte{down}), " from ", s.imei)
+	}
+}
+
 func (s *TY905) SaveToDB(dbHelper *dbh.DbHelper) error {
-	log.Debug("called save to db")
-	dbh.SaveToDB(s.imei, s.lat, s.lon, s.speed, s.heading, s.gpsTime, dbHelper)
-	return nil
+	return dbh.SaveEvent(&dbh.Position{Imei: s.imei, Lat: s.lat, Lon: s.lon, Speed: s.speed, Heading: s.heading,
+		Ts: s.gpsTime, NoGPS: s.noGPS}, dbHelper)
 }
 
 func SimNumberToIP(sim []byte) []byte {
@@ -0,0 +1,57 @@
+package ty905
+
+import (
+	"encoding/hex"
+	. "lbsas/datatypes"
+	"testing"
+)
+
+// a frame of the cmd and content, with the length and checksum filled
+func frame(cmd byte, content string) []byte {
+	c, _ := hex.DecodeString(content)
+	ret := append([]byte{0x29, 0x29, cmd, 0, byte(len(c) + 6), 0x0a, 0x01, 0x02, 0x03}, c...)
+	return append(ret, checkSum(ret), 0x0d)
+}
+
+func TestParseMessage(t *testing.T) {
+	buff := frame(MSG_CMD_UP_ACK, "21000000")
+	m := parseMessage(buff)
+	if m == nil || m.MajorCmd[0] != MSG_CMD_UP_ACK || hex.EncodeToString(m.IP) != "0a010203" ||
+		hex.EncodeToString(m.Content) != "21000000" {
+		t.Fatal("unexpected message:", m)
+	}
+	// the rest of a padded buffer is ignored
+	if parseMessage(append(buff, 0, 0, 0)) == nil {
+		t.Fatal("expected a message")
+	}
+	buff[10] ^= 0xff
+	if parseMessage(buff) != nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+	if parseMessage(buff[:len(buff)-1]) != nil {
+		t.Fatal("expected a truncated frame")
+	}
+}
+
+func TestDecodeGeo(t *testing.T) {
+	geo := "150612193050" + "22328099" + "11403506" + "0036" + "0180" + "80" + "000000000000000000000000000000"
+	s := &TY905{rawPacket: RawUdpPacket{Buff: frame(MSG_CMD_UP_NORM_GEO, geo)}}
+	if !s.IsValid() || !s.decodeGeo() {
+		t.Fatal("expected a geo message")
+	}
+	if s.noGPS || s.speed != "36" || s.heading != "180" || s.lat[:4] != "22.5" || s.lon[:5] != "114.0" {
+		t.Fatal("unexpected geo data:", s.lat, s.lon, s.speed, s.heading, s.noGPS)
+	}
+
+	// no fix
+	geo = geo[:36] + "00" + geo[38:]
+	s = &TY905{rawPacket: RawUdpPacket{Buff: frame(MSG_CMD_UP_NORM_GEO, geo)}}
+	if !s.IsValid() || !s.decodeGeo() || !s.noGPS || s.gpsTime == 0 {
+		t.Fatal("expected a report without fix:", s.lat, s.gpsTime)
+	}
+
+	s = &TY905{rawPacket: RawUdpPacket{Buff: frame(MSG_CMD_UP_TIME_PROTO, "150612193050")}}
+	if !s.IsValid() || !s.decodeTime() || !s.noGPS || s.gpsTime == 0 {
+		t.Fatal("expected a time report")
+	}
+}